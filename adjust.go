@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// adjustments are tonal and color corrections applied to the resized image
+// before dithering.
+type adjustments struct {
+	// autoLevels is the percentage of pixels clipped at each end when
+	// stretching the histogram, 0 to leave levels alone
+	autoLevels float64
+	// brightness is added, as a fraction of full scale
+	brightness float64
+	// contrast scales the distance from mid gray
+	contrast float64
+	// gamma above 1 brightens the midtones
+	gamma float64
+	// saturation scales the distance from the pixel's luma
+	saturation float64
+	// sharpen is the unsharp mask amount, radius its Gaussian sigma in pixels
+	sharpen, radius float64
+}
+
+func (a *adjustments) neutral() bool {
+	return a.autoLevels == 0 && a.brightness == 0 && a.contrast == 1 &&
+		a.gamma == 1 && a.saturation == 1 && a.sharpen == 0
+}
+
+func (a *adjustments) validate() error {
+	switch {
+	case a.autoLevels < 0 || a.autoLevels >= 50:
+		return fmt.Errorf("auto levels clip %g%% is not in [0, 50)", a.autoLevels)
+	case a.contrast < 0:
+		return fmt.Errorf("contrast %g is negative", a.contrast)
+	case a.gamma <= 0:
+		return fmt.Errorf("gamma %g is not positive", a.gamma)
+	case a.saturation < 0:
+		return fmt.Errorf("saturation %g is negative", a.saturation)
+	case a.sharpen < 0:
+		return fmt.Errorf("sharpen amount %g is negative", a.sharpen)
+	case a.sharpen > 0 && a.radius <= 0:
+		return fmt.Errorf("sharpen radius %g is not positive", a.radius)
+	}
+	return nil
+}
+
+// adjust returns img corrected by a, or img itself when a changes nothing.
+func adjust(img image.Image, a *adjustments) image.Image {
+	if a.neutral() {
+		return img
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	lo, hi := 0.0, 255.0
+	if a.autoLevels > 0 {
+		lo, hi = levels(dst, a.autoLevels)
+	}
+
+	var lut [256]uint8
+	for i := range lut {
+		v := (float64(i) - lo) / (hi - lo)
+		v += a.brightness
+		v = (v-0.5)*a.contrast + 0.5
+		v = math.Max(0, math.Min(1, v))
+		if a.gamma != 1 {
+			v = math.Pow(v, 1/a.gamma)
+		}
+		lut[i] = clamp(int(math.Round(v * 255)))
+	}
+
+	pix := dst.Pix
+	for i := 0; i < len(pix); i += 4 {
+		r, g, b := float64(lut[pix[i]]), float64(lut[pix[i+1]]), float64(lut[pix[i+2]])
+		if a.saturation != 1 {
+			y := 0.2126*r + 0.7152*g + 0.0722*b
+			r = y + (r-y)*a.saturation
+			g = y + (g-y)*a.saturation
+			b = y + (b-y)*a.saturation
+		}
+		pix[i] = clamp(int(math.Round(r)))
+		pix[i+1] = clamp(int(math.Round(g)))
+		pix[i+2] = clamp(int(math.Round(b)))
+	}
+
+	if a.sharpen > 0 {
+		unsharpMask(dst, a.sharpen, a.radius)
+	}
+	return dst
+}
+
+// levels returns the channel values below and above which clip percent of
+// all channel samples lie.
+func levels(img *image.RGBA, clip float64) (float64, float64) {
+	var hist [256]int
+	for i := 0; i < len(img.Pix); i += 4 {
+		hist[img.Pix[i]]++
+		hist[img.Pix[i+1]]++
+		hist[img.Pix[i+2]]++
+	}
+	total := len(img.Pix) / 4 * 3
+	limit := int(float64(total) * clip / 100)
+
+	lo, count := 0, 0
+	for ; lo < 255; lo++ {
+		if count += hist[lo]; count > limit {
+			break
+		}
+	}
+	hi, count := 255, 0
+	for ; hi > 0; hi-- {
+		if count += hist[hi]; count > limit {
+			break
+		}
+	}
+	if hi <= lo {
+		return 0, 255
+	}
+	return float64(lo), float64(hi)
+}
+
+// unsharpMask adds amount times the difference between img and its Gaussian
+// blur of the given sigma.
+func unsharpMask(img *image.RGBA, amount, sigma float64) {
+	radius := max(1, int(math.Ceil(3*sigma)))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	blur := func(src []float64, step, n, stride, lines int) []float64 {
+		dst := make([]float64, len(src))
+		for l := 0; l < lines; l++ {
+			base := l * stride
+			for i := 0; i < n; i++ {
+				for c := 0; c < 3; c++ {
+					var v float64
+					for k, kv := range kernel {
+						j := max(0, min(n-1, i+k-radius))
+						v += src[base+j*step+c] * kv
+					}
+					dst[base+i*step+c] = v
+				}
+			}
+		}
+		return dst
+	}
+
+	orig := make([]float64, w*h*3)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := y*img.Stride + x*4
+			o := (y*w + x) * 3
+			orig[o], orig[o+1], orig[o+2] = float64(img.Pix[p]), float64(img.Pix[p+1]), float64(img.Pix[p+2])
+		}
+	}
+	// rows, then columns
+	blurred := blur(blur(orig, 3, w, w*3, h), w*3, h, 3, w)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := y*img.Stride + x*4
+			o := (y*w + x) * 3
+			for c := 0; c < 3; c++ {
+				img.Pix[p+c] = clamp(int(math.Round(orig[o+c] + amount*(orig[o+c]-blurred[o+c]))))
+			}
+		}
+	}
+}
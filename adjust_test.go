@@ -0,0 +1,204 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// grayRamp is a 256x1 image holding every gray level once.
+func grayRamp() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 1))
+	for x := 0; x < 256; x++ {
+		img.SetRGBA(x, 0, color.RGBA{uint8(x), uint8(x), uint8(x), 0xff})
+	}
+	return img
+}
+
+func neutralAdjustments() *adjustments {
+	return &adjustments{contrast: 1, gamma: 1, saturation: 1, radius: 1}
+}
+
+func TestAdjustLUT(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		set   func(a *adjustments)
+		curve func(v float64) float64
+	}{
+		{"brightness", func(a *adjustments) { a.brightness = 0.1 }, func(v float64) float64 { return v + 0.1 }},
+		{"darker", func(a *adjustments) { a.brightness = -0.25 }, func(v float64) float64 { return v - 0.25 }},
+		{"contrast", func(a *adjustments) { a.contrast = 2 }, func(v float64) float64 { return (v-0.5)*2 + 0.5 }},
+		{"flat", func(a *adjustments) { a.contrast = 0 }, func(v float64) float64 { return 0.5 }},
+		{"gamma", func(a *adjustments) { a.gamma = 2 }, math.Sqrt},
+		{"brightness before gamma", func(a *adjustments) {
+			a.brightness, a.gamma = -0.2, 0.5
+		}, func(v float64) float64 { return math.Pow(math.Max(0, v-0.2), 2) }},
+	} {
+		a := neutralAdjustments()
+		tc.set(a)
+		got := adjust(grayRamp(), a).(*image.RGBA)
+		for x := 0; x < 256; x++ {
+			// rounded, so off by at most half a level
+			want := math.Max(0, math.Min(1, tc.curve(float64(x)/255))) * 255
+			c := got.RGBAAt(x, 0)
+			if math.Abs(float64(c.R)-want) > 0.5+1e-9 || c.G != c.R || c.B != c.R || c.A != 0xff {
+				t.Errorf("%s: %d became %v, want %.2f", tc.name, x, c, want)
+				break
+			}
+		}
+	}
+}
+
+func TestAdjustNeutral(t *testing.T) {
+	img := grayRamp()
+	if got := adjust(img, neutralAdjustments()); got != image.Image(img) {
+		t.Error("neutral adjustments copied the image")
+	}
+}
+
+func TestAdjustSaturation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.SetRGBA(0, 0, color.RGBA{200, 100, 50, 0xff})
+	a := neutralAdjustments()
+	a.saturation = 0
+	luma := uint8(math.Round(0.2126*200 + 0.7152*100 + 0.0722*50))
+	if c := adjust(img, a).(*image.RGBA).RGBAAt(0, 0); c != (color.RGBA{luma, luma, luma, 0xff}) {
+		t.Errorf("desaturated to %v, want gray %d", c, luma)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	// gray levels 0 to 99, three samples each
+	img := image.NewRGBA(image.Rect(0, 0, 100, 1))
+	for x := 0; x < 100; x++ {
+		img.SetRGBA(x, 0, color.RGBA{uint8(x), uint8(x), uint8(x), 0xff})
+	}
+	for _, tc := range []struct {
+		clip   float64
+		lo, hi float64
+	}{
+		{0, 0, 99},
+		{5, 5, 94},
+		{10, 10, 89},
+	} {
+		if lo, hi := levels(img, tc.clip); lo != tc.lo || hi != tc.hi {
+			t.Errorf("clip %g%%: levels %g-%g, want %g-%g", tc.clip, lo, hi, tc.lo, tc.hi)
+		}
+	}
+
+	flat := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if lo, hi := levels(flat, 5); lo != 0 || hi != 255 {
+		t.Errorf("flat image: levels %g-%g, want the full range", lo, hi)
+	}
+
+	// the clipped ends map to black and white, the rest stretches between
+	a := neutralAdjustments()
+	a.autoLevels = 5
+	got := adjust(img, a).(*image.RGBA)
+	for x, want := range map[int]uint8{0: 0, 5: 0, 50: 129, 94: 255, 99: 255} {
+		if c := got.RGBAAt(x, 0).R; c != want {
+			t.Errorf("auto levels: %d became %d, want %d", x, c, want)
+		}
+	}
+}
+
+// edgeImage is w x 1, dark on the left half and light on the right.
+func edgeImage(w int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, 1))
+	for x := 0; x < w; x++ {
+		v := uint8(64)
+		if x >= w/2 {
+			v = 192
+		}
+		img.SetRGBA(x, 0, color.RGBA{v, v, v, 0xff})
+	}
+	return img
+}
+
+func TestUnsharpMask(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range flat.Pix {
+		flat.Pix[i] = 0x80
+	}
+	unsharpMask(flat, 2, 1)
+	for i, v := range flat.Pix {
+		if v != 0x80 {
+			t.Fatalf("flat image changed at %d to %d", i, v)
+		}
+	}
+
+	img := edgeImage(20)
+	unsharpMask(img, 1, 1)
+	for x := 0; x < 20; x++ {
+		v := img.RGBAAt(x, 0)
+		if v.R != v.G || v.G != v.B || v.A != 0xff {
+			t.Fatalf("pixel %d became %v", x, v)
+		}
+		switch {
+		case x == 9:
+			if v.R >= 64 {
+				t.Errorf("dark side of the edge is %d, want below 64", v.R)
+			}
+		case x == 10:
+			if v.R <= 192 {
+				t.Errorf("light side of the edge is %d, want above 192", v.R)
+			}
+		case x < 5 || x >= 15:
+			if v.R != 64 && v.R != 192 {
+				t.Errorf("pixel %d away from the edge became %d", x, v.R)
+			}
+		}
+	}
+	// the halo is symmetric around the edge
+	for d := 0; d < 10; d++ {
+		if lo, hi := img.RGBAAt(9-d, 0).R, img.RGBAAt(10+d, 0).R; int(lo)-64 != 192-int(hi) {
+			t.Errorf("halo %d from the edge: %d and %d are not symmetric", d, lo, hi)
+		}
+	}
+
+	// a larger amount sharpens more
+	weak, strong := edgeImage(20), edgeImage(20)
+	unsharpMask(weak, 0.5, 1)
+	unsharpMask(strong, 2, 1)
+	if strong.RGBAAt(10, 0).R-strong.RGBAAt(9, 0).R <= weak.RGBAAt(10, 0).R-weak.RGBAAt(9, 0).R {
+		t.Error("amount 2 sharpened less than 0.5")
+	}
+}
+
+// The contain bars are drawn after every correction, so they keep the exact
+// --background color whatever the corrections do to the image.
+func TestContainBarsKeepBackground(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 300, 30))
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 300; x++ {
+			src.SetRGBA(x, y, color.RGBA{uint8(x / 2), uint8(100 + y), uint8(255 - x/3), 0xff})
+		}
+	}
+	for _, args := range [][]string{
+		{"--auto-levels", "5"},
+		{"--auto-levels", "2", "--contrast", "1.5", "--gamma", "1.4", "--brightness", "0.1", "--saturation", "1.5", "--sharpen", "2"},
+		{"--auto-levels", "5", "--clahe"},
+		{"--auto-levels", "5", "--gamut-map", "1"},
+	} {
+		conv := testConversion(t, append([]string{"--fit", "contain", "--background", "red"}, args...)...)
+		img, _, err := conv.prepare(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := color.RGBAModel.Convert(conv.fit.background.color).(color.RGBA)
+		bounds := img.Bounds()
+		// the content is as wide as the view, so the bars are above and below
+		barH := (bounds.Dy() - int(math.Round(float64(bounds.Dx())*30/300))) / 2
+		if barH < 1 {
+			t.Fatalf("%v: no bars in %v", args, bounds)
+		}
+		for _, y := range []int{0, barH - 1, bounds.Dy() - barH, bounds.Dy() - 1} {
+			for x := 0; x < bounds.Dx(); x++ {
+				if c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA); c != want {
+					t.Fatalf("%v: bar pixel %d,%d is %v, want %v", args, x, y, c, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// opaque reports whether img has no transparent pixels.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// alphaBackground is the backdrop for transparent inputs: the palette color
+// named by spec or, failing that, the image file at spec. The file is decoded
+// once and stretched to each input size it is laid under.
+type alphaBackground struct {
+	uniform *image.Uniform
+	img     image.Image
+	filter  *resampleFilter
+
+	mu sync.Mutex
+	// sized is img stretched to the size last asked for; inputs of a batch
+	// or frames of an animation usually share it
+	sized image.Image
+}
+
+func newAlphaBackground(spec string, pal *paletteProfile, f *resampleFilter) (*alphaBackground, error) {
+	if e, err := pal.entry(spec); err == nil {
+		return &alphaBackground{uniform: image.NewUniform(e.color)}, nil
+	} else if _, statErr := os.Stat(spec); statErr != nil {
+		return nil, errors.Wrap(err, "alpha background is neither a palette color nor a file")
+	}
+
+	in, err := os.Open(spec)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode alpha background %s", spec)
+	}
+	return &alphaBackground{img: img, filter: f}, nil
+}
+
+// at returns the backdrop for a width x height input.
+func (b *alphaBackground) at(width, height int) image.Image {
+	if b.uniform != nil {
+		return b.uniform
+	}
+	b.mu.Lock()
+	sized := b.sized
+	b.mu.Unlock()
+	if sized != nil && sized.Bounds().Size() == image.Pt(width, height) {
+		return sized
+	}
+
+	sized = b.filter.resample(b.img, width, height)
+	b.mu.Lock()
+	b.sized = sized
+	b.mu.Unlock()
+	return sized
+}
+
+// composite lays img over bg. Partly transparent pixels are blended in linear
+// light like the resize filters, so antialiased edges and soft shadows keep
+// their brightness instead of darkening as a blend of sRGB values does.
+func composite(img, bg image.Image) image.Image {
+	bounds, bgMin := img.Bounds(), bg.Bounds().Min
+	dst := newCanvas(img, bounds.Dx(), bounds.Dy())
+	pix, stride, bpp := pixels(dst)
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			fg := color.NRGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA64)
+			if fg.A == 0xffff {
+				putColor(pix[y*stride+x*bpp:], bpp, color.RGBA64{fg.R, fg.G, fg.B, 0xffff})
+				continue
+			}
+			back := color.RGBA64Model.Convert(bg.At(bgMin.X+x, bgMin.Y+y)).(color.RGBA64)
+			if fg.A == 0 {
+				putColor(pix[y*stride+x*bpp:], bpp, back)
+				continue
+			}
+
+			a := float64(fg.A) / 0xffff
+			var out [3]float64
+			for c, v := range [3][2]uint16{{fg.R, back.R}, {fg.G, back.G}, {fg.B, back.B}} {
+				out[c] = linearFromSRGB(float64(v[0])/257)*a + linearFromSRGB(float64(v[1])/257)*(1-a)
+			}
+			if bpp == 8 {
+				putSRGB16(pix[y*stride+x*bpp:], out[0], out[1], out[2])
+			} else {
+				p := pix[y*stride+x*bpp:]
+				p[0], p[1], p[2], p[3] = linearToSRGB(out[0]), linearToSRGB(out[1]), linearToSRGB(out[2]), 0xff
+			}
+		}
+	}
+	return dst
+}
+
+// putColor stores the opaque c in a pixel of bpp bytes of a canvas.
+func putColor(p []byte, bpp int, c color.RGBA64) {
+	if bpp == 8 {
+		p[0], p[1], p[2], p[3] = byte(c.R>>8), byte(c.R), byte(c.G>>8), byte(c.G)
+		p[4], p[5], p[6], p[7] = byte(c.B>>8), byte(c.B), 0xff, 0xff
+		return
+	}
+	p[0], p[1], p[2], p[3] = byte(c.R>>8), byte(c.G>>8), byte(c.B>>8), 0xff
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestComposite(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{200, 100, 50, 0xff})
+	img.SetNRGBA(1, 0, color.NRGBA{0xff, 0xff, 0xff, 0})
+	img.SetNRGBA(2, 0, color.NRGBA{0xff, 0xff, 0xff, 0x80})
+	got := composite(img, image.NewUniform(color.RGBA{10, 20, 30, 0xff}))
+	a := float64(0x8080) / 0xffff
+
+	for x, want := range []color.RGBA{
+		{200, 100, 50, 0xff},
+		{10, 20, 30, 0xff},
+		// half white in linear light, brighter than the sRGB midpoint
+		{
+			linearToSRGB(a + (1-a)*srgbToLinear[10]),
+			linearToSRGB(a + (1-a)*srgbToLinear[20]),
+			linearToSRGB(a + (1-a)*srgbToLinear[30]),
+			0xff,
+		},
+	} {
+		if c := got.At(x, 0).(color.RGBA); c != want {
+			t.Errorf("pixel %d is %v, want %v", x, c, want)
+		}
+	}
+	if c := got.At(2, 0).(color.RGBA); c.R <= (0xff+10)/2 {
+		t.Errorf("half white over dark blended in sRGB: %v", c)
+	}
+}
+
+func TestComposite16(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA64(0, 0, color.NRGBA64{0x1234, 0x5678, 0x9abc, 0xffff})
+	img.SetNRGBA64(1, 0, color.NRGBA64{0, 0, 0, 0})
+	got := composite(img, image.NewUniform(color.RGBA64{0xffff, 0x8000, 0, 0xffff}))
+	for x, want := range []color.RGBA64{{0x1234, 0x5678, 0x9abc, 0xffff}, {0xffff, 0x8000, 0, 0xffff}} {
+		if c := got.At(x, 0).(color.RGBA64); c != want {
+			t.Errorf("pixel %d is %v, want %v", x, c, want)
+		}
+	}
+}
+
+func TestAlphaBackgroundFile(t *testing.T) {
+	bgFile := filepath.Join(t.TempDir(), "bg.png")
+	f, err := os.Create(bgFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bgImg := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range bgImg.Pix {
+		bgImg.Pix[i] = 0x40
+	}
+	if err := png.Encode(f, bgImg); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	pal := testConversion(t).pal
+	bg, err := newAlphaBackground(bgFile, pal, resampleFilters["bilinear"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is read once, removing it does not matter any more
+	os.Remove(bgFile)
+	first := bg.at(8, 2)
+	if first.Bounds() != image.Rect(0, 0, 8, 2) {
+		t.Fatalf("stretched to %v", first.Bounds())
+	}
+	if bg.at(8, 2) != first {
+		t.Error("resampled again for the same size")
+	}
+	if other := bg.at(3, 5); other.Bounds() != image.Rect(0, 0, 3, 5) {
+		t.Errorf("stretched to %v, want 3x5", other.Bounds())
+	}
+
+	if _, err := newAlphaBackground("white", pal, nil); err != nil {
+		t.Error(err)
+	}
+	for _, spec := range []string{"nope", t.TempDir()} {
+		if _, err := newAlphaBackground(spec, pal, nil); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// imageExtensions are the file extensions convert img --recursive picks up.
+var imageExtensions = map[string]bool{
+	".bmp": true, ".gif": true, ".jpeg": true, ".jpg": true,
+	".png": true, ".tif": true, ".tiff": true, ".webp": true,
+}
+
+// isOutputName reports whether name looks like a bmp written by convert img,
+// such as photo.jpg.bmp or anim.gif.001.bmp.
+func isOutputName(name string) bool {
+	if !strings.EqualFold(filepath.Ext(name), ".bmp") {
+		return false
+	}
+	name = strings.TrimSuffix(name, filepath.Ext(name))
+	if frame := filepath.Ext(name); len(frame) > 1 && strings.Trim(frame[1:], "0123456789") == "" {
+		name = strings.TrimSuffix(name, frame)
+	}
+	return imageExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// batchFile is one input of a tree and where its outputs go.
+type batchFile struct {
+	input      string
+	outputBase string
+	skipped    bool
+	err        error
+}
+
+// upToDate reports whether the outputs of f are newer than its input.
+func (f *batchFile) upToDate(frames bool) bool {
+	output := f.outputBase + ".epa"
+	if frames {
+		output = f.outputBase + ".playlist"
+	}
+	in, err := os.Stat(f.input)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(output)
+	return err == nil && !out.ModTime().Before(in.ModTime())
+}
+
+// convertTree converts every image under the directory argument, mirroring
+// the tree into --out, with a bounded number of conversions in flight. A
+// failing file does not stop the others, they are all listed at the end.
+func convertTree(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return errors.New("Usage: convert img --recursive photos/ [--out build/]")
+	}
+	root := c.Args()[0]
+	if info, err := os.Stat(root); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("--recursive needs a directory, %s is not one", root)
+	}
+	out := c.String("out")
+	if out == "" {
+		out = root
+	}
+	jobs := c.Int("jobs")
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+	if jobs < 1 {
+		return fmt.Errorf("jobs %d is not positive", jobs)
+	}
+
+	conv, err := newConversion(c)
+	if err != nil {
+		return err
+	}
+
+	var files []*batchFile
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		// an unreadable entry fails alone, the rest of the tree is converted
+		if err != nil {
+			fmt.Println("Failed", path)
+			files = append(files, &batchFile{input: path, err: err})
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			// outputs nested in the input tree are not inputs
+			if path != root && filepath.Clean(path) == filepath.Clean(out) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !imageExtensions[strings.ToLower(filepath.Ext(path))] || isOutputName(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &batchFile{input: path, outputBase: filepath.Join(out, rel)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	force := c.Bool("force")
+	var mu sync.Mutex
+	work := make(chan *batchFile)
+	var wg sync.WaitGroup
+	for i := 0; i < min(jobs, len(files)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range work {
+				if !force && f.upToDate(conv.frames != nil) {
+					f.skipped = true
+					continue
+				}
+				f.err = os.MkdirAll(filepath.Dir(f.outputBase), 0755)
+				if f.err == nil {
+					_, f.err = conv.convertFile(f.input, f.outputBase, io.Discard)
+				}
+
+				mu.Lock()
+				if f.err != nil {
+					fmt.Println("Failed", f.input)
+				} else {
+					fmt.Println("Converted", f.input)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		if f.err == nil {
+			work <- f
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	var converted, skipped int
+	var failed []*batchFile
+	for _, f := range files {
+		switch {
+		case f.err != nil:
+			failed = append(failed, f)
+		case f.skipped:
+			skipped++
+		default:
+			converted++
+		}
+	}
+	fmt.Printf("%d files: %d converted, %d unchanged, %d failed\n",
+		len(files), converted, skipped, len(failed))
+	for _, f := range failed {
+		// most errors already name the file
+		if strings.Contains(f.err.Error(), f.input) {
+			fmt.Printf("  %v\n", f.err)
+		} else {
+			fmt.Printf("  %s: %v\n", f.input, f.err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d files failed", len(failed), len(files))
+	}
+	return nil
+}
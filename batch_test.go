@@ -0,0 +1,171 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsOutputName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"photo.jpg.bmp":    true,
+		"photo.JPG.BMP":    true,
+		"anim.gif.001.bmp": true,
+		"pages.tif.12.bmp": true,
+		"photo.bmp":        false,
+		"photo.jpg":        false,
+		"notes.txt.bmp":    false,
+		"anim.gif.x1.bmp":  false,
+		"anim.001.bmp":     false,
+	} {
+		if got := isOutputName(name); got != want {
+			t.Errorf("%q: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+// writeTree creates files under root, PNG images for image names and the
+// given content otherwise.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content == "" {
+			err = png.Encode(f, image.NewGray(image.Rect(0, 0, 8, 6)))
+		} else {
+			_, err = f.WriteString(content)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func runTree(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	return captureStdout(t, func() error {
+		return convertTree(imgContext(t, append([]string{"--recursive", "--jobs", "2"}, args...)...))
+	})
+}
+
+func TestConvertTree(t *testing.T) {
+	root, out := t.TempDir(), t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.png":                "",
+		"sub/b.png":            "",
+		"sub/bad.jpg":          "not a jpeg",
+		"notes.txt":            "not an image",
+		"a.png.bmp":            "an output of an earlier run",
+		"sub/anim.gif.001.bmp": "an output of an earlier run",
+	})
+
+	output, err := runTree(t, "--out", out, root)
+	if err == nil || err.Error() != "1 of 3 files failed" {
+		t.Fatalf("got %v, want 1 of 3 files failed", err)
+	}
+	if !strings.Contains(output, "3 files: 2 converted, 0 unchanged, 1 failed") {
+		t.Errorf("no summary in:\n%s", output)
+	}
+	if !strings.Contains(output, filepath.Join(root, "sub", "bad.jpg")) {
+		t.Errorf("failure not listed in:\n%s", output)
+	}
+	for _, name := range []string{"a.png.epa", "a.png.bmp", "sub/b.png.epa"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	// outputs lying in the input tree are not converted again
+	if _, err := os.Stat(filepath.Join(out, "a.png.bmp.epa")); err == nil {
+		t.Error("converted a.png.bmp")
+	}
+
+	// outputs newer than their inputs are kept, unless forced
+	old := time.Now().Add(-time.Hour)
+	epa := filepath.Join(out, "a.png.epa")
+	for _, name := range []string{"a.png", "sub/b.png"} {
+		if err := os.Chtimes(filepath.Join(root, name), old.Add(-time.Hour), old.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(out, name+".epa"), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	output, _ = runTree(t, "--out", out, root)
+	if !strings.Contains(output, "3 files: 0 converted, 2 unchanged, 1 failed") {
+		t.Errorf("up to date outputs converted again:\n%s", output)
+	}
+	if info, err := os.Stat(epa); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("a.png.epa rewritten: %v", err)
+	}
+
+	// a newer input is converted again
+	if err := os.Chtimes(filepath.Join(root, "a.png"), time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	output, _ = runTree(t, "--out", out, root)
+	if !strings.Contains(output, "3 files: 1 converted, 1 unchanged, 1 failed") {
+		t.Errorf("changed input not converted:\n%s", output)
+	}
+
+	output, _ = runTree(t, "--out", out, "--force", root)
+	if !strings.Contains(output, "3 files: 2 converted, 0 unchanged, 1 failed") {
+		t.Errorf("--force skipped files:\n%s", output)
+	}
+}
+
+func TestConvertTreeUnreadableDirectory(t *testing.T) {
+	root, out := t.TempDir(), t.TempDir()
+	writeTree(t, root, map[string]string{"a.png": "", "z.png": ""})
+
+	// a directory nested beyond the longest path the system resolves, so
+	// the walk fails on it even for root
+	t.Chdir(root)
+	name := strings.Repeat("d", 250)
+	for i := 0; i < 20; i++ {
+		if err := os.Mkdir(name, 0755); err != nil {
+			t.Skipf("cannot nest directories: %v", err)
+		}
+		t.Chdir(name)
+	}
+	writeTree(t, ".", map[string]string{"deep.png": ""})
+
+	output, err := runTree(t, "--out", out, root)
+	if err == nil || !strings.Contains(err.Error(), "files failed") {
+		t.Fatalf("got %v, want failed files", err)
+	}
+	if !strings.Contains(output, "2 converted") || !strings.Contains(output, "Failed "+filepath.Join(root, name)) {
+		t.Errorf("the walk did not go on past the unreadable directory:\n%s", output)
+	}
+	for _, name := range []string{"a.png.epa", "z.png.epa"} {
+		if _, err := os.Stat(filepath.Join(out, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestBatchFlagsNeedRecursive(t *testing.T) {
+	for _, args := range [][]string{
+		{"--jobs", "2", "a.png"},
+		{"--jobs", "0", "a.png"},
+		{"--force", "a.png"},
+	} {
+		err := convertImage(imgContext(t, args...))
+		if err == nil || !strings.Contains(err.Error(), "needs --recursive") {
+			t.Errorf("%v: got %v", args, err)
+		}
+	}
+}
@@ -3,6 +3,8 @@ import aioble
 import bluetooth
 import os
 import struct
+import hashlib
+import cryptolib
 
 aioble.log_level=2
 ble_apprearance = 0x0300
@@ -15,6 +17,155 @@ NOTIFY_CHAR_UUID = bluetooth.UUID(0x6e41)  # Notify
 
 FILE_DIR = "/"
 
+# Uploads arrive split into writes that fit the MTU: the first starts with
+# method 1, and the rest of the 20 byte header (MD5 and size) and the content
+# follow in raw continuation writes without a method byte. Clients before
+# chunked uploads sent the whole request in one write, which is still
+# accepted.
+
+# start of an upload request whose header is still arriving
+pending_header = None
+
+# (file, name, remaining bytes) of an upload whose content is still arriving
+pending_upload = None
+
+# Hex encoded pre-shared key. When the file exists every client must run the
+# handshake (method 5) first, and all later frames are AES-256-GCM encrypted.
+PSK_FILE = "psk.key"
+
+def load_psk():
+    try:
+        with open(PSK_FILE) as f:
+            return bytes.fromhex(f.read().strip())
+    except OSError:
+        return None
+
+PSK = load_psk()
+
+# === Session encryption ===
+SESSION_INFO = b"blecli session v1"
+DIR_CLIENT_TO_SERVER = 0x01
+DIR_SERVER_TO_CLIENT = 0x02
+_GCM_R = 0xE1 << 120
+
+def hmac_sha256(key, msg):
+    if len(key) > 64:
+        key = hashlib.sha256(key).digest()
+    key = key + b"\x00" * (64 - len(key))
+    inner = hashlib.sha256(bytes(b ^ 0x36 for b in key) + msg).digest()
+    return hashlib.sha256(bytes(b ^ 0x5C for b in key) + inner).digest()
+
+def derive_session_key(psk, client_nonce, server_nonce):
+    # HKDF-SHA256 with a single 32 byte output block
+    prk = hmac_sha256(client_nonce + server_nonce, psk)
+    return hmac_sha256(prk, SESSION_INFO + b"\x01")
+
+def _gf_mul(x, y):
+    # bit by bit, only used to build the tables below
+    z = 0
+    for i in range(127, -1, -1):
+        if (y >> i) & 1:
+            z ^= x
+        if x & 1:
+            x = (x >> 1) ^ _GCM_R
+        else:
+            x >>= 1
+    return z
+
+def _mul_x4(x):
+    for _ in range(4):
+        x = (x >> 1) ^ _GCM_R if x & 1 else x >> 1
+    return x
+
+# reduction of the four bits shifted out when multiplying by x^4
+_GCM_R4 = [_mul_x4(i) for i in range(16)]
+
+def _gf_mul_table(x, table):
+    # Horner over the 32 nibbles of x, highest degree first, with table[n]
+    # holding the nibble n times H: 32 steps instead of 128 per block
+    z = 0
+    for shift in range(0, 128, 4):
+        z = (z >> 4) ^ _GCM_R4[z & 0xF] ^ table[(x >> shift) & 0xF]
+    return z
+
+class Session:
+    """AES-256-GCM frame encryption, matching secureTransport in the client.
+
+    Each frame is an 8 byte big endian sequence number followed by the
+    ciphertext and 16 byte tag. The nonce is the direction byte, three zero
+    bytes and the sequence number.
+    """
+
+    def __init__(self, key):
+        self.aes = cryptolib.aes(key, 1)  # ECB, used as the block cipher
+        h = int.from_bytes(self._block(b"\x00" * 16), "big")
+        self.h_table = [_gf_mul(n << 124, h) for n in range(16)]
+        self.send_seq = 0
+        self.recv_seq = 0
+
+    def _block(self, data):
+        return self.aes.encrypt(data)
+
+    def _ghash(self, aad, data):
+        x = 0
+        for part in (aad, data):
+            for i in range(0, len(part), 16):
+                chunk = part[i:i + 16]
+                chunk = chunk + b"\x00" * (16 - len(chunk))
+                x = _gf_mul_table(x ^ int.from_bytes(chunk, "big"), self.h_table)
+        x = _gf_mul_table(x ^ (len(aad) * 8 << 64) ^ (len(data) * 8), self.h_table)
+        return x
+
+    def _ctr(self, nonce, data):
+        counters = bytearray()
+        for i in range((len(data) + 15) // 16):
+            counters += nonce + struct.pack(">I", i + 2)
+        stream = self._block(bytes(counters))
+        return bytes(a ^ b for a, b in zip(data, stream))
+
+    def _tag(self, nonce, ciphertext, aad=b""):
+        s = self._ghash(aad, ciphertext) ^ int.from_bytes(self._block(nonce + b"\x00\x00\x00\x01"), "big")
+        return s.to_bytes(16, "big")
+
+    def confirm(self, client_nonce, server_nonce):
+        # key confirmation: the tag of an empty frame with sequence number 0,
+        # which frames never use, over both nonces
+        return self._tag(self._nonce(DIR_SERVER_TO_CLIENT, 0), b"", client_nonce + server_nonce)
+
+    def _nonce(self, direction, seq):
+        return bytes([direction, 0, 0, 0]) + struct.pack(">Q", seq)
+
+    def seal(self, data):
+        self.send_seq += 1
+        nonce = self._nonce(DIR_SERVER_TO_CLIENT, self.send_seq)
+        ciphertext = self._ctr(nonce, data)
+        return struct.pack(">Q", self.send_seq) + ciphertext + self._tag(nonce, ciphertext)
+
+    def open(self, frame):
+        if len(frame) < 8 + 16:
+            raise ValueError("short frame")
+        seq = struct.unpack(">Q", frame[:8])[0]
+        if seq <= self.recv_seq:
+            raise ValueError("replayed frame")
+        nonce = self._nonce(DIR_CLIENT_TO_SERVER, seq)
+        ciphertext = frame[8:-16]
+        if self._tag(nonce, ciphertext) != frame[-16:]:
+            raise ValueError("bad tag")
+        self.recv_seq = seq
+        return self._ctr(nonce, ciphertext)
+
+class SecureNotifier:
+    """Wraps the notify characteristic and encrypts once a session exists."""
+
+    def __init__(self, notify_char):
+        self.notify_char = notify_char
+        self.session = None
+
+    def notify(self, conn, data):
+        if self.session:
+            data = self.session.seal(data)
+        self.notify_char.notify(conn, data)
+
 async def handle_echo(notify_char, conn, data):
     print("received echo request, echo back: ", data)
     notify_char.notify(conn, data)  # Echo back data
@@ -115,9 +266,10 @@ async def start_file_receiver(bt, write_char, connection):
             file.close()
     
 async def handle_save_file(write_char, notify_char, conn, data):
-    if len(data) < 21:
-        print(f"[UPLOAD] err: too short, only {len(data)} byte")
-        notify_char.notify(conn, b"ERR:Too short")
+    if len(data) < 20:
+        # the header continues in the next write
+        global pending_header
+        pending_header = bytes([1]) + data
         return
 
     md5name = binascii.hexlify(data[:16]).decode()
@@ -125,7 +277,7 @@ async def handle_save_file(write_char, notify_char, conn, data):
     file_size = struct.unpack(">I", data[16:20])[0]
     content = data[20:]
     content_size = len(content)
-    if content_size != file_size:
+    if content_size > file_size:
         print(f"[UPLOAD] Filename={md5name}: wrong size {file_size} != {content_size}")
         notify_char.notify(conn, b"ERR:Size mismatch")
         return
@@ -133,11 +285,48 @@ async def handle_save_file(write_char, notify_char, conn, data):
     print(f"[UPLOAD] Filename={md5name} Size={file_size}")
 
     try:
-        with open(FILE_DIR + "/" + md5name, "wb") as f:
-            f.write(content)
-        notify_char.notify(conn, b"ACK:OK")
+        f = open(FILE_DIR + "/" + md5name, "wb")
+        f.write(content)
     except Exception as e:
         notify_char.notify(conn, "ERR:{str(e)}".encode())
+        return
+
+    if content_size < file_size:
+        # the rest of the file follows in raw continuation writes
+        global pending_upload
+        pending_upload = (f, md5name, file_size - content_size)
+        return
+
+    f.close()
+    notify_char.notify(conn, b"ACK:OK")
+
+async def handle_upload_chunk(notify_char, conn, data):
+    global pending_upload
+    f, md5name, remaining = pending_upload
+    if len(data) > remaining:
+        print(f"[UPLOAD] Filename={md5name}: {len(data) - remaining} byte too many")
+        f.close()
+        pending_upload = None
+        notify_char.notify(conn, b"ERR:Size mismatch")
+        return
+
+    try:
+        f.write(data)
+    except Exception as e:
+        f.close()
+        pending_upload = None
+        notify_char.notify(conn, "ERR:{str(e)}".encode())
+        return
+
+    remaining -= len(data)
+    if remaining > 0:
+        pending_upload = (f, md5name, remaining)
+        return
+
+    f.close()
+    pending_upload = None
+    print(f"[UPLOAD] Filename={md5name} complete")
+    notify_char.notify(conn, b"ACK:OK")
             
 async def handle_delete_file(notify_char, conn, data):
     if len(data) != 20:
@@ -169,7 +358,42 @@ async def handle_delete_file(notify_char, conn, data):
     except Exception as e:
         print("delete file: ", e)
             
+async def handle_handshake(notify_char, conn, data):
+    if PSK is None:
+        print("[HANDSHAKE] no psk configured")
+        notify_char.notify(conn, b"ERR:NO PSK")
+        return
+    if len(data) != 16:
+        print(f"[HANDSHAKE] wrong nonce length {len(data)}")
+        notify_char.notify(conn, b"ERR:WRONG REQUEST")
+        return
+
+    server_nonce = os.urandom(16)
+    session = Session(derive_session_key(PSK, data, server_nonce))
+    notify_char.session = None
+    notify_char.notify(conn, bytes([5]) + server_nonce + session.confirm(data, server_nonce))
+    notify_char.session = session
+    print("[HANDSHAKE] session established")
+
 async def handle_data(write_char, notify_char, conn, data):
+    if notify_char.session:
+        try:
+            data = notify_char.session.open(data)
+        except Exception as e:
+            print("decrypt failed:", e)
+            return
+    elif PSK is not None and data[0] != 5:
+        print("rejecting unencrypted request")
+        notify_char.notify(conn, b"ERR:HANDSHAKE REQUIRED")
+        return
+
+    global pending_header
+    if pending_header:
+        data, pending_header = pending_header + data, None
+    elif pending_upload:
+        await handle_upload_chunk(notify_char, conn, data)
+        return
+
     method = data[0]
     print("received method: ", method)
 
@@ -193,11 +417,18 @@ async def handle_data(write_char, notify_char, conn, data):
     elif method == 4:
         await handle_get_file(notify_char, conn, data[1:])
 
+    # Method 5: Encryption handshake
+    elif method == 5:
+        await handle_handshake(notify_char, conn, data[1:])
+
     else:
         await send_notify(b"ERR:Unknown method")
 
 
 async def writer_loop(write_char, notify_char, conn):
+    global pending_header, pending_upload
+    pending_header = None
+    pending_upload = None
     try:
         while conn.is_connected():
             print("Written by device: ", conn.device)
@@ -250,7 +481,7 @@ async def connection_handler():
             ) as conn:
                 print("Connected to:", conn.device)
                 
-                writer_task = asyncio.create_task(writer_loop(write_char, notify_char,conn))
+                writer_task = asyncio.create_task(writer_loop(write_char, SecureNotifier(notify_char), conn))
 
                 while conn.is_connected():
                     await asyncio.sleep(0.5)
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// claheBins is the number of lightness levels CLAHE works with.
+const claheBins = 256
+
+// clahe applies contrast limited adaptive histogram equalization to the
+// Oklab lightness of img, leaving hue and chroma alone. Each tile x tile
+// block gets its own equalization curve, its histogram clipped at clip
+// times the average bin so noise in flat areas is not amplified. Pixels
+// blend the curves of the four nearest tiles and move by how much that
+// shifts their bin, keeping their place within it.
+func clahe(img image.Image, tile int, clip float64) (image.Image, error) {
+	if tile < 8 {
+		return nil, fmt.Errorf("CLAHE tile size %d is below 8 pixels", tile)
+	}
+	if clip < 1 {
+		return nil, fmt.Errorf("CLAHE clip limit %g is below 1", clip)
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	lab := make([][3]float64, w*h)
+	bins := make([]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := y*dst.Stride + x*4
+			v := srgbToOklab(float64(dst.Pix[p]), float64(dst.Pix[p+1]), float64(dst.Pix[p+2]))
+			lab[y*w+x] = v
+			bins[y*w+x] = max(0, min(claheBins-1, int(v[0]*(claheBins-1)+0.5)))
+		}
+	}
+
+	tilesX, tilesY := (w+tile-1)/tile, (h+tile-1)/tile
+	curves := make([][claheBins]float64, tilesX*tilesY)
+	for ty := 0; ty < tilesY; ty++ {
+		for tx := 0; tx < tilesX; tx++ {
+			var hist [claheBins]int
+			x0, y0 := tx*tile, ty*tile
+			x1, y1 := min(w, x0+tile), min(h, y0+tile)
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					hist[bins[y*w+x]]++
+				}
+			}
+			curves[ty*tilesX+tx] = equalize(hist, (x1-x0)*(y1-y0), clip)
+		}
+	}
+
+	// tile centers are at (t + 0.5) * tile; outside them the nearest
+	// curves are used unblended
+	locate := func(v, tiles int) (int, int, float64) {
+		f := (float64(v)+0.5)/float64(tile) - 0.5
+		t0 := int(math.Floor(f))
+		frac := f - float64(t0)
+		t1 := t0 + 1
+		t0 = max(0, min(tiles-1, t0))
+		t1 = max(0, min(tiles-1, t1))
+		return t0, t1, frac
+	}
+
+	for y := 0; y < h; y++ {
+		ty0, ty1, fy := locate(y, tilesY)
+		for x := 0; x < w; x++ {
+			tx0, tx1, fx := locate(x, tilesX)
+			i := y*w + x
+			b := bins[i]
+			top := curves[ty0*tilesX+tx0][b]*(1-fx) + curves[ty0*tilesX+tx1][b]*fx
+			bottom := curves[ty1*tilesX+tx0][b]*(1-fx) + curves[ty1*tilesX+tx1][b]*fx
+
+			v := lab[i]
+			v[0] += top*(1-fy) + bottom*fy - float64(b)/(claheBins-1)
+			r, g, bl := oklabToLinear(v)
+			p := y*dst.Stride + x*4
+			dst.Pix[p] = linearToSRGB(r)
+			dst.Pix[p+1] = linearToSRGB(g)
+			dst.Pix[p+2] = linearToSRGB(bl)
+		}
+	}
+	return dst, nil
+}
+
+// equalize returns the clipped equalization curve of a tile histogram,
+// mapping each bin to a lightness in [0, 1]. A bin's pixels land inside its
+// span of the cumulative histogram as far in as the bin's own lightness, so
+// a uniform histogram, and a tile of one lightness, map onto themselves.
+func equalize(hist [claheBins]int, pixels int, clip float64) [claheBins]float64 {
+	limit := math.Max(1, clip*float64(pixels)/claheBins)
+	var clipped [claheBins]float64
+	excess := 0.0
+	for i, n := range hist {
+		clipped[i] = math.Min(float64(n), limit)
+		excess += float64(n) - clipped[i]
+	}
+	// spread the clipped counts evenly over all bins
+	share := excess / claheBins
+
+	var curve [claheBins]float64
+	sum := 0.0
+	for i, n := range clipped {
+		n += share
+		curve[i] = (sum + n*float64(i)/(claheBins-1)) / float64(pixels)
+		sum += n
+	}
+	return curve
+}
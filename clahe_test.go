@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func flatImage(w, h int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestCLAHEFlatImage(t *testing.T) {
+	for _, c := range []color.RGBA{
+		{0, 0, 0, 0xff},
+		{37, 37, 37, 0xff},
+		{128, 128, 128, 0xff},
+		{255, 255, 255, 0xff},
+		{200, 100, 50, 0xff},
+		{20, 90, 160, 0xff},
+	} {
+		for _, clip := range []float64{1, 2, 10} {
+			src := flatImage(100, 70, c)
+			got, err := clahe(src, 32, clip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.(*image.RGBA).Pix, src.Pix) {
+				t.Errorf("%v with clip %g changed to %v", c, clip, got.At(50, 35))
+			}
+		}
+	}
+}
+
+func TestEqualizeUniform(t *testing.T) {
+	var hist [claheBins]int
+	for i := range hist {
+		hist[i] = 10
+	}
+	for _, clip := range []float64{1, 2, 100} {
+		curve := equalize(hist, 10*claheBins, clip)
+		for i, v := range curve {
+			if want := float64(i) / (claheBins - 1); math.Abs(v-want) > 1e-12 {
+				t.Fatalf("clip %g: bin %d maps to %g, want %g", clip, i, v, want)
+			}
+		}
+	}
+}
+
+// gain is the steepest slope of curve, 1 being the identity.
+func gain(curve [claheBins]float64) float64 {
+	g := 0.0
+	for i := 1; i < claheBins; i++ {
+		g = math.Max(g, (curve[i]-curve[i-1])*(claheBins-1))
+	}
+	return g
+}
+
+func TestEqualizeClipBoundsGain(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	peaks := func(centers ...int) (hist [claheBins]int) {
+		for _, c := range centers {
+			for d := -2; d <= 2; d++ {
+				hist[c+d] += 500
+			}
+		}
+		return
+	}
+	var random [claheBins]int
+	for i := range random {
+		random[i] = rng.Intn(50) * rng.Intn(50)
+	}
+	for name, hist := range map[string][claheBins]int{
+		"one peak":   peaks(128),
+		"two peaks":  peaks(40, 200),
+		"dark peak":  peaks(3),
+		"light peak": peaks(252),
+		"random":     random,
+	} {
+		pixels := 0
+		for _, n := range hist {
+			pixels += n
+		}
+		for _, clip := range []float64{1, 2, 4, 8} {
+			curve := equalize(hist, pixels, clip)
+			// the clipped bins plus their share of the excess
+			if g := gain(curve); g > clip+1 {
+				t.Errorf("%s, clip %g: gain %.2f", name, clip, g)
+			}
+			if curve[0] != 0 || math.Abs(curve[claheBins-1]-1) > 1e-12 {
+				t.Errorf("%s, clip %g: curve spans %g to %g", name, clip, curve[0], curve[claheBins-1])
+			}
+			for i := 1; i < claheBins; i++ {
+				if curve[i] < curve[i-1] {
+					t.Fatalf("%s, clip %g: curve falls at bin %d", name, clip, i)
+				}
+			}
+		}
+		// without a limit a narrow histogram is stretched much further
+		if name != "random" {
+			if g := gain(equalize(hist, pixels, claheBins)); g < 20 {
+				t.Errorf("%s unclipped: gain only %.2f", name, g)
+			}
+		}
+	}
+}
+
+func TestCLAHEClipLimitsContrast(t *testing.T) {
+	// a dull gradient in one tile
+	src := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(110 + x/4)
+			src.SetRGBA(x, y, color.RGBA{v, v, v, 0xff})
+		}
+	}
+	lightness := func(img image.Image, x int) float64 {
+		c := color.RGBAModel.Convert(img.At(x, 32)).(color.RGBA)
+		return srgbToOklab(float64(c.R), float64(c.G), float64(c.B))[0]
+	}
+	span := lightness(src, 63) - lightness(src, 0)
+
+	prev := 1.0
+	for _, clip := range []float64{1, 2, 4, 16} {
+		got, err := clahe(src, 64, clip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stretch := (lightness(got, 63) - lightness(got, 0)) / span
+		if stretch > clip+1 {
+			t.Errorf("clip %g stretched contrast %.2f times", clip, stretch)
+		}
+		if stretch < prev {
+			t.Errorf("clip %g stretched contrast %.2f times, less than a lower clip", clip, stretch)
+		}
+		prev = stretch
+	}
+	if prev < 4 {
+		t.Errorf("clip 16 only stretched contrast %.2f times", prev)
+	}
+}
+
+func TestCLAHEErrors(t *testing.T) {
+	src := flatImage(16, 16, color.RGBA{1, 2, 3, 0xff})
+	if _, err := clahe(src, 7, 2); err == nil {
+		t.Error("accepted a 7 pixel tile")
+	}
+	if _, err := clahe(src, 8, 0.5); err == nil {
+		t.Error("accepted a clip limit below 1")
+	}
+}
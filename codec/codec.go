@@ -0,0 +1,137 @@
+// Package codec encodes and decodes the frames of the BLE file protocol.
+//
+// A request frame is one method byte followed by a method specific body. A
+// response frame is notified without a method byte, so decoding it needs the
+// method of the request it answers.
+package codec
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Method identifies the operation of a request.
+type Method byte
+
+const (
+	Echo Method = iota
+	Upload
+	Delete
+	List
+	Get
+	Handshake
+)
+
+func (m Method) String() string {
+	switch m {
+	case Echo:
+		return "echo"
+	case Upload:
+		return "upload"
+	case Delete:
+		return "delete"
+	case List:
+		return "list"
+	case Get:
+		return "get"
+	case Handshake:
+		return "handshake"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// MD5Size is the size of a file digest on the wire.
+	MD5Size = 16
+	// NonceSize is the size of a handshake nonce.
+	NonceSize = 16
+	// ConfirmSize is the size of the key confirmation in a handshake
+	// response.
+	ConfirmSize = 16
+	// FileHeaderSize is the size of the digest and size header used by
+	// upload and delete.
+	FileHeaderSize = MD5Size + 4
+)
+
+var (
+	ErrEmptyFrame    = errors.New("empty frame")
+	ErrUnknownMethod = errors.New("unknown method")
+	ErrMalformed     = errors.New("malformed frame")
+)
+
+func malformed(m Method, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s: %s", ErrMalformed, m, fmt.Sprintf(format, args...))
+}
+
+// MD5 is the digest that names a file on the server.
+type MD5 [MD5Size]byte
+
+// ParseMD5 parses 32 hex characters.
+func ParseMD5(s string) (MD5, error) {
+	var sum MD5
+	if len(s) != 2*MD5Size {
+		return sum, fmt.Errorf("MD5 must be %d hex characters, got %d", 2*MD5Size, len(s))
+	}
+	_, err := hex.Decode(sum[:], []byte(s))
+	return sum, err
+}
+
+func (s MD5) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// Message is a request or a response.
+type Message interface {
+	Method() Method
+	// Encode returns the frame. Requests start with their method byte,
+	// responses do not.
+	Encode() ([]byte, error)
+}
+
+// DecodeRequest decodes a request frame.
+func DecodeRequest(frame []byte) (Message, error) {
+	if len(frame) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	m, body := Method(frame[0]), frame[1:]
+	switch m {
+	case Echo:
+		return decodeEchoRequest(body)
+	case Upload:
+		return decodeUploadRequest(body)
+	case Delete:
+		return decodeDeleteRequest(body)
+	case List:
+		return decodeListRequest(body)
+	case Get:
+		return decodeGetRequest(body)
+	case Handshake:
+		return decodeHandshakeRequest(body)
+	default:
+		return nil, fmt.Errorf("%w 0x%02x", ErrUnknownMethod, frame[0])
+	}
+}
+
+// DecodeResponse decodes a response frame answering a request of method m.
+func DecodeResponse(m Method, frame []byte) (Message, error) {
+	switch m {
+	case Echo:
+		return &EchoResponse{Payload: clone(frame)}, nil
+	case Upload, Delete:
+		return decodeStatusResponse(m, frame)
+	case List:
+		return decodeListResponse(frame)
+	case Get:
+		return &GetResponse{Content: clone(frame)}, nil
+	case Handshake:
+		return decodeHandshakeResponse(frame)
+	default:
+		return nil, fmt.Errorf("%w 0x%02x", ErrUnknownMethod, byte(m))
+	}
+}
+
+func clone(b []byte) []byte {
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,206 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testMD5 = MD5{0x5d, 0x99, 0xbc, 0xc5, 0x94, 0x2b, 0x5b, 0x7d, 0xf7, 0xb9, 0x67, 0x9b, 0x4f, 0x88, 0xf5, 0x2e}
+
+var requests = []Message{
+	&EchoRequest{Payload: []byte("ping!")},
+	&EchoRequest{},
+	&UploadRequest{MD5: testMD5, Size: 5, Content: []byte("hello")},
+	&UploadRequest{MD5: testMD5, Size: 192000, Content: []byte("partial")},
+	&DeleteRequest{MD5: testMD5, Size: 192000},
+	&ListRequest{},
+	&GetRequest{Name: "5d99bcc5942b5b7df7b9679b4f88f52e"},
+	&HandshakeRequest{Nonce: [NonceSize]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+}
+
+var responses = []Message{
+	&EchoResponse{Payload: []byte("pong!")},
+	&StatusResponse{Request: Upload, OK: true, Message: "OK"},
+	&StatusResponse{Request: Upload, Message: "Size mismatch"},
+	&StatusResponse{Request: Delete, OK: true, Message: "DELETED"},
+	&ListResponse{},
+	&ListResponse{Files: []FileInfo{{Name: "5d99bcc5942b5b7df7b9679b4f88f52e", Size: 192000}, {Name: "boot.py", Size: 412}}},
+	&GetResponse{Content: []byte{0x00, 0x11, 0x66}},
+	&HandshakeResponse{
+		Nonce:   [NonceSize]byte{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1},
+		Confirm: [ConfirmSize]byte{0xc0, 0xff, 0xee, 15: 0x01},
+	},
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, req := range requests {
+		frame, err := req.Encode()
+		if err != nil {
+			t.Fatalf("%s: encode: %v", req.Method(), err)
+		}
+		if Method(frame[0]) != req.Method() {
+			t.Errorf("%s: frame starts with 0x%02x", req.Method(), frame[0])
+		}
+		got, err := DecodeRequest(frame)
+		if err != nil {
+			t.Fatalf("%s: decode %x: %v", req.Method(), frame, err)
+		}
+		again, _ := got.Encode()
+		if !bytes.Equal(frame, again) {
+			t.Errorf("%s: re-encoded %x, want %x", req.Method(), again, frame)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	for _, resp := range responses {
+		frame, err := resp.Encode()
+		if err != nil {
+			t.Fatalf("%s: encode: %v", resp.Method(), err)
+		}
+		got, err := DecodeResponse(resp.Method(), frame)
+		if err != nil {
+			t.Fatalf("%s: decode %q: %v", resp.Method(), frame, err)
+		}
+		again, _ := got.Encode()
+		if !bytes.Equal(frame, again) {
+			t.Errorf("%s: re-encoded %q, want %q", resp.Method(), again, frame)
+		}
+	}
+}
+
+func TestUploadRequestFields(t *testing.T) {
+	frame := append([]byte{byte(Upload)}, testMD5[:]...)
+	frame = append(frame, 0x00, 0x02, 0xee, 0x00)
+	frame = append(frame, "abc"...)
+
+	msg, err := DecodeRequest(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := msg.(*UploadRequest)
+	if req.MD5 != testMD5 || req.Size != 192000 || string(req.Content) != "abc" {
+		t.Errorf("decoded %s", req)
+	}
+	if req.Remaining() != 192000-3 {
+		t.Errorf("remaining %d", req.Remaining())
+	}
+}
+
+func TestListResponseFields(t *testing.T) {
+	msg, err := DecodeResponse(List, []byte("a,1;b,22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []FileInfo{{Name: "a", Size: 1}, {Name: "b", Size: 22}}
+	if got := msg.(*ListResponse).Files; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"empty", nil, ErrEmptyFrame},
+		{"unknown method", []byte{0x7f}, ErrUnknownMethod},
+		{"short upload header", []byte{byte(Upload), 1, 2, 3}, ErrMalformed},
+		{"upload content beyond size", append(append([]byte{byte(Upload)}, make([]byte, 16)...), 0, 0, 0, 1, 'a', 'b'), ErrMalformed},
+		{"long delete", append([]byte{byte(Delete)}, make([]byte, 21)...), ErrMalformed},
+		{"list with body", []byte{byte(List), 0}, ErrMalformed},
+		{"get without name", []byte{byte(Get)}, ErrMalformed},
+		{"short handshake", []byte{byte(Handshake), 1}, ErrMalformed},
+	} {
+		if _, err := DecodeRequest(tc.frame); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		m     Method
+		frame string
+	}{
+		{Upload, "OK"},
+		{Delete, ""},
+		{List, "a;b"},
+		{List, "a,-1"},
+		{List, ",1"},
+		{List, "a,1;"},
+		{Handshake, "\x05short"},
+		// a nonce without confirmation, as servers before key confirmation sent
+		{Handshake, "\x05" + strings.Repeat("n", NonceSize)},
+	} {
+		if _, err := DecodeResponse(tc.m, []byte(tc.frame)); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s response %q: got %v, want %v", tc.m, tc.frame, err, ErrMalformed)
+		}
+	}
+}
+
+func TestParseMD5(t *testing.T) {
+	sum, err := ParseMD5("5d99bcc5942b5b7df7b9679b4f88f52e")
+	if err != nil || sum != testMD5 {
+		t.Errorf("got %s, %v", sum, err)
+	}
+	for _, s := range []string{"", "5d99", "zz99bcc5942b5b7df7b9679b4f88f52e"} {
+		if _, err := ParseMD5(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	for _, req := range requests {
+		frame, _ := req.Encode()
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		msg, err := DecodeRequest(frame)
+		if err != nil {
+			return
+		}
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("decoded %#v does not encode: %v", msg, err)
+		}
+		again, err := DecodeRequest(encoded)
+		if err != nil {
+			t.Fatalf("re-encoded %x does not decode: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("round trip changed %#v to %#v", msg, again)
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	for _, resp := range responses {
+		frame, _ := resp.Encode()
+		f.Add(byte(resp.Method()), frame)
+	}
+	f.Fuzz(func(t *testing.T, method byte, frame []byte) {
+		m := Method(method)
+		msg, err := DecodeResponse(m, frame)
+		if err != nil {
+			return
+		}
+		if msg.Method() != m {
+			t.Fatalf("decoded %s response as %s", m, msg.Method())
+		}
+		encoded, err := msg.Encode()
+		if err != nil {
+			t.Fatalf("decoded %#v does not encode: %v", msg, err)
+		}
+		again, err := DecodeResponse(m, encoded)
+		if err != nil {
+			t.Fatalf("re-encoded %q does not decode: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(msg, again) {
+			t.Fatalf("round trip changed %#v to %#v", msg, again)
+		}
+	})
+}
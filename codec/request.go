@@ -0,0 +1,175 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EchoRequest asks the server to notify the payload back.
+type EchoRequest struct {
+	Payload []byte
+}
+
+func (r *EchoRequest) Method() Method { return Echo }
+
+func (r *EchoRequest) Encode() ([]byte, error) {
+	return append([]byte{byte(Echo)}, r.Payload...), nil
+}
+
+func (r *EchoRequest) String() string {
+	return fmt.Sprintf("%q", r.Payload)
+}
+
+func decodeEchoRequest(body []byte) (*EchoRequest, error) {
+	return &EchoRequest{Payload: clone(body)}, nil
+}
+
+// UploadRequest starts a file upload. Content holds the bytes carried by
+// this frame; when it is shorter than Size the rest follows in continuation
+// writes without a method byte. Clients may split the encoded request at any
+// byte, so the header itself can span several writes.
+type UploadRequest struct {
+	MD5     MD5
+	Size    uint32
+	Content []byte
+}
+
+func (r *UploadRequest) Method() Method { return Upload }
+
+func (r *UploadRequest) Encode() ([]byte, error) {
+	if uint64(len(r.Content)) > uint64(r.Size) {
+		return nil, malformed(Upload, "content of %dB exceeds size %d", len(r.Content), r.Size)
+	}
+	buf := make([]byte, 1+FileHeaderSize, 1+FileHeaderSize+len(r.Content))
+	buf[0] = byte(Upload)
+	putFileHeader(buf[1:], r.MD5, r.Size)
+	return append(buf, r.Content...), nil
+}
+
+// Remaining returns how many content bytes follow in continuation writes.
+func (r *UploadRequest) Remaining() int {
+	return int(r.Size) - len(r.Content)
+}
+
+func (r *UploadRequest) String() string {
+	return fmt.Sprintf("md5=%s size=%d content=%dB", r.MD5, r.Size, len(r.Content))
+}
+
+func decodeUploadRequest(body []byte) (*UploadRequest, error) {
+	if len(body) < FileHeaderSize {
+		return nil, malformed(Upload, "header needs %dB, got %dB", FileHeaderSize, len(body))
+	}
+	r := &UploadRequest{Content: clone(body[FileHeaderSize:])}
+	r.MD5, r.Size = fileHeader(body)
+	if uint64(len(r.Content)) > uint64(r.Size) {
+		return nil, malformed(Upload, "content of %dB exceeds size %d", len(r.Content), r.Size)
+	}
+	return r, nil
+}
+
+// DeleteRequest deletes the file with the given digest and size.
+type DeleteRequest struct {
+	MD5  MD5
+	Size uint32
+}
+
+func (r *DeleteRequest) Method() Method { return Delete }
+
+func (r *DeleteRequest) Encode() ([]byte, error) {
+	buf := make([]byte, 1+FileHeaderSize)
+	buf[0] = byte(Delete)
+	putFileHeader(buf[1:], r.MD5, r.Size)
+	return buf, nil
+}
+
+func (r *DeleteRequest) String() string {
+	return fmt.Sprintf("md5=%s size=%d", r.MD5, r.Size)
+}
+
+func decodeDeleteRequest(body []byte) (*DeleteRequest, error) {
+	if len(body) != FileHeaderSize {
+		return nil, malformed(Delete, "body must be %dB, got %dB", FileHeaderSize, len(body))
+	}
+	r := &DeleteRequest{}
+	r.MD5, r.Size = fileHeader(body)
+	return r, nil
+}
+
+// ListRequest asks for all stored files.
+type ListRequest struct{}
+
+func (r *ListRequest) Method() Method { return List }
+
+func (r *ListRequest) Encode() ([]byte, error) {
+	return []byte{byte(List)}, nil
+}
+
+func (r *ListRequest) String() string {
+	return ""
+}
+
+func decodeListRequest(body []byte) (*ListRequest, error) {
+	if len(body) != 0 {
+		return nil, malformed(List, "unexpected %dB body", len(body))
+	}
+	return &ListRequest{}, nil
+}
+
+// GetRequest asks for the content of one file.
+type GetRequest struct {
+	Name string
+}
+
+func (r *GetRequest) Method() Method { return Get }
+
+func (r *GetRequest) Encode() ([]byte, error) {
+	if r.Name == "" {
+		return nil, malformed(Get, "empty name")
+	}
+	return append([]byte{byte(Get)}, r.Name...), nil
+}
+
+func (r *GetRequest) String() string {
+	return fmt.Sprintf("name=%q", r.Name)
+}
+
+func decodeGetRequest(body []byte) (*GetRequest, error) {
+	if len(body) == 0 {
+		return nil, malformed(Get, "empty name")
+	}
+	return &GetRequest{Name: string(body)}, nil
+}
+
+// HandshakeRequest starts an encrypted session.
+type HandshakeRequest struct {
+	Nonce [NonceSize]byte
+}
+
+func (r *HandshakeRequest) Method() Method { return Handshake }
+
+func (r *HandshakeRequest) Encode() ([]byte, error) {
+	return append([]byte{byte(Handshake)}, r.Nonce[:]...), nil
+}
+
+func (r *HandshakeRequest) String() string {
+	return fmt.Sprintf("nonce=%x", r.Nonce)
+}
+
+func decodeHandshakeRequest(body []byte) (*HandshakeRequest, error) {
+	if len(body) != NonceSize {
+		return nil, malformed(Handshake, "nonce must be %dB, got %dB", NonceSize, len(body))
+	}
+	r := &HandshakeRequest{}
+	copy(r.Nonce[:], body)
+	return r, nil
+}
+
+func putFileHeader(buf []byte, sum MD5, size uint32) {
+	copy(buf, sum[:])
+	binary.BigEndian.PutUint32(buf[MD5Size:], size)
+}
+
+func fileHeader(buf []byte) (sum MD5, size uint32) {
+	copy(sum[:], buf)
+	return sum, binary.BigEndian.Uint32(buf[MD5Size:])
+}
@@ -0,0 +1,160 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ackPrefix = "ACK:"
+	errPrefix = "ERR:"
+)
+
+// EchoResponse carries the echoed payload.
+type EchoResponse struct {
+	Payload []byte
+}
+
+func (r *EchoResponse) Method() Method { return Echo }
+
+func (r *EchoResponse) Encode() ([]byte, error) {
+	return clone(r.Payload), nil
+}
+
+func (r *EchoResponse) String() string {
+	return string(r.Payload)
+}
+
+// StatusResponse answers upload and delete requests with "ACK:<message>" or
+// "ERR:<message>".
+type StatusResponse struct {
+	Request Method
+	OK      bool
+	Message string
+}
+
+func (r *StatusResponse) Method() Method { return r.Request }
+
+func (r *StatusResponse) Encode() ([]byte, error) {
+	if r.OK {
+		return []byte(ackPrefix + r.Message), nil
+	}
+	return []byte(errPrefix + r.Message), nil
+}
+
+func (r *StatusResponse) String() string {
+	b, _ := r.Encode()
+	return string(b)
+}
+
+func decodeStatusResponse(m Method, frame []byte) (*StatusResponse, error) {
+	switch {
+	case bytes.HasPrefix(frame, []byte(ackPrefix)):
+		return &StatusResponse{Request: m, OK: true, Message: string(frame[len(ackPrefix):])}, nil
+	case bytes.HasPrefix(frame, []byte(errPrefix)):
+		return &StatusResponse{Request: m, Message: string(frame[len(errPrefix):])}, nil
+	default:
+		return nil, malformed(m, "status %q has neither %s nor %s prefix", frame, ackPrefix, errPrefix)
+	}
+}
+
+// FileInfo is one entry of a list response.
+type FileInfo struct {
+	Name string
+	Size int64
+}
+
+// ListResponse lists the stored files as "<name>,<size>;<name>,<size>...".
+type ListResponse struct {
+	Files []FileInfo
+}
+
+func (r *ListResponse) Method() Method { return List }
+
+func (r *ListResponse) Encode() ([]byte, error) {
+	entries := make([]string, 0, len(r.Files))
+	for _, f := range r.Files {
+		if f.Name == "" || strings.ContainsAny(f.Name, ",;") {
+			return nil, malformed(List, "invalid file name %q", f.Name)
+		}
+		if f.Size < 0 {
+			return nil, malformed(List, "negative size %d for %s", f.Size, f.Name)
+		}
+		entries = append(entries, f.Name+","+strconv.FormatInt(f.Size, 10))
+	}
+	return []byte(strings.Join(entries, ";")), nil
+}
+
+func (r *ListResponse) String() string {
+	b, err := r.Encode()
+	if err != nil {
+		return fmt.Sprintf("%v", r.Files)
+	}
+	return string(b)
+}
+
+func decodeListResponse(frame []byte) (*ListResponse, error) {
+	r := &ListResponse{}
+	if len(frame) == 0 {
+		return r, nil
+	}
+	for _, entry := range strings.Split(string(frame), ";") {
+		name, size, ok := strings.Cut(entry, ",")
+		if !ok || name == "" {
+			return nil, malformed(List, "invalid entry %q", entry)
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return nil, malformed(List, "invalid size in entry %q", entry)
+		}
+		r.Files = append(r.Files, FileInfo{Name: name, Size: n})
+	}
+	return r, nil
+}
+
+// GetResponse carries the content of the requested file.
+type GetResponse struct {
+	Content []byte
+}
+
+func (r *GetResponse) Method() Method { return Get }
+
+func (r *GetResponse) Encode() ([]byte, error) {
+	return clone(r.Content), nil
+}
+
+func (r *GetResponse) String() string {
+	return fmt.Sprintf("%dB", len(r.Content))
+}
+
+// HandshakeResponse carries the server nonce and a key confirmation, proof
+// that the server derived the same session key. It is the only response that
+// starts with its method byte, so it can be told apart from encrypted frames.
+type HandshakeResponse struct {
+	Nonce   [NonceSize]byte
+	Confirm [ConfirmSize]byte
+}
+
+func (r *HandshakeResponse) Method() Method { return Handshake }
+
+func (r *HandshakeResponse) Encode() ([]byte, error) {
+	buf := append([]byte{byte(Handshake)}, r.Nonce[:]...)
+	return append(buf, r.Confirm[:]...), nil
+}
+
+func (r *HandshakeResponse) String() string {
+	return fmt.Sprintf("nonce=%x confirm=%x", r.Nonce, r.Confirm)
+}
+
+func decodeHandshakeResponse(frame []byte) (*HandshakeResponse, error) {
+	if len(frame) != 1+NonceSize+ConfirmSize || Method(frame[0]) != Handshake {
+		return nil, malformed(Handshake, "response must be method byte, %dB nonce and %dB confirmation, got %dB",
+			NonceSize, ConfirmSize, len(frame))
+	}
+	r := &HandshakeResponse{}
+	copy(r.Nonce[:], frame[1:])
+	copy(r.Confirm[:], frame[1+NonceSize:])
+	return r, nil
+}
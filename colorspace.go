@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+)
+
+// srgbToLinear maps an 8 bit sRGB channel to linear light in [0, 1].
+var srgbToLinear = func() (t [256]float64) {
+	for i := range t {
+		t[i] = decodeSRGB(float64(i) / 255)
+	}
+	return
+}()
+
+func decodeSRGB(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearFromSRGB converts a possibly fractional sRGB value in [0, 255].
+func linearFromSRGB(v float64) float64 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 1
+	}
+	i := int(v)
+	if float64(i) == v {
+		return srgbToLinear[i]
+	}
+	return decodeSRGB(v / 255)
+}
+
+// D65 reference white
+const (
+	whiteX = 0.95047
+	whiteY = 1.0
+	whiteZ = 1.08883
+)
+
+func linearToXYZ(r, g, b float64) (x, y, z float64) {
+	x = 0.4124564*r + 0.3575761*g + 0.1804375*b
+	y = 0.2126729*r + 0.7151522*g + 0.0721750*b
+	z = 0.0193339*r + 0.1191920*g + 0.9503041*b
+	return
+}
+
+func labF(t float64) float64 {
+	const delta = 6.0 / 29
+	if t > delta*delta*delta {
+		return math.Cbrt(t)
+	}
+	return t/(3*delta*delta) + 4.0/29
+}
+
+// srgbToLab converts sRGB in [0, 255] to CIELAB under D65.
+func srgbToLab(r, g, b float64) [3]float64 {
+	x, y, z := linearToXYZ(linearFromSRGB(r), linearFromSRGB(g), linearFromSRGB(b))
+	fx, fy, fz := labF(x/whiteX), labF(y/whiteY), labF(z/whiteZ)
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// srgbToOklab converts sRGB in [0, 255] to Oklab.
+func srgbToOklab(r, g, b float64) [3]float64 {
+	return linearToOklab(linearFromSRGB(r), linearFromSRGB(g), linearFromSRGB(b))
+}
+
+func linearToOklab(r, g, b float64) [3]float64 {
+	l := math.Cbrt(0.4122214708*r + 0.5363325363*g + 0.0514459929*b)
+	m := math.Cbrt(0.2119034982*r + 0.6806995451*g + 0.1073969566*b)
+	s := math.Cbrt(0.0883024619*r + 0.2817188376*g + 0.6299787005*b)
+	return [3]float64{
+		0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// oklabToLinear converts Oklab to linear sRGB, which may be out of [0, 1].
+func oklabToLinear(lab [3]float64) (r, g, b float64) {
+	l := lab[0] + 0.3963377774*lab[1] + 0.2158037573*lab[2]
+	m := lab[0] - 0.1055613458*lab[1] - 0.0638541728*lab[2]
+	s := lab[0] - 0.0894841775*lab[1] - 1.2914855480*lab[2]
+	l, m, s = l*l*l, m*m*m, s*s*s
+	r = 4.0767416621*l - 3.3077115913*m + 0.2309699292*s
+	g = -1.2684380046*l + 2.6097574011*m - 0.3413193965*s
+	b = -0.0041960863*l - 0.7034186147*m + 1.7076147010*s
+	return
+}
+
+// ciede2000 returns the CIEDE2000 color difference of two CIELAB colors.
+func ciede2000(lab1, lab2 [3]float64) float64 {
+	const deg = math.Pi / 180
+	l1, a1, b1 := lab1[0], lab1[1], lab1[2]
+	l2, a2, b2 := lab2[0], lab2[1], lab2[2]
+
+	c1 := math.Hypot(a1, b1)
+	c2 := math.Hypot(a2, b2)
+	cMean7 := math.Pow((c1+c2)/2, 7)
+	g := 0.5 * (1 - math.Sqrt(cMean7/(cMean7+6103515625))) // 25^7
+
+	a1p, a2p := (1+g)*a1, (1+g)*a2
+	c1p, c2p := math.Hypot(a1p, b1), math.Hypot(a2p, b2)
+	h1p, h2p := hueAngle(b1, a1p), hueAngle(b2, a2p)
+
+	dLp := l2 - l1
+	dCp := c2p - c1p
+	var dhp float64
+	switch {
+	case c1p*c2p == 0:
+		dhp = 0
+	case math.Abs(h2p-h1p) <= 180:
+		dhp = h2p - h1p
+	case h2p-h1p > 180:
+		dhp = h2p - h1p - 360
+	default:
+		dhp = h2p - h1p + 360
+	}
+	dHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(dhp/2*deg)
+
+	lMean := (l1 + l2) / 2
+	cMean := (c1p + c2p) / 2
+	var hMean float64
+	switch {
+	case c1p*c2p == 0:
+		hMean = h1p + h2p
+	case math.Abs(h1p-h2p) <= 180:
+		hMean = (h1p + h2p) / 2
+	case h1p+h2p < 360:
+		hMean = (h1p + h2p + 360) / 2
+	default:
+		hMean = (h1p + h2p - 360) / 2
+	}
+
+	t := 1 - 0.17*math.Cos((hMean-30)*deg) + 0.24*math.Cos(2*hMean*deg) +
+		0.32*math.Cos((3*hMean+6)*deg) - 0.20*math.Cos((4*hMean-63)*deg)
+	dTheta := 30 * math.Exp(-math.Pow((hMean-275)/25, 2))
+	cMeanP7 := math.Pow(cMean, 7)
+	rc := 2 * math.Sqrt(cMeanP7/(cMeanP7+6103515625))
+	l50 := (lMean - 50) * (lMean - 50)
+	sl := 1 + 0.015*l50/math.Sqrt(20+l50)
+	sc := 1 + 0.045*cMean
+	sh := 1 + 0.015*cMean*t
+	rt := -math.Sin(2*dTheta*deg) * rc
+
+	return math.Sqrt(math.Pow(dLp/sl, 2) + math.Pow(dCp/sc, 2) + math.Pow(dHp/sh, 2) +
+		rt*(dCp/sc)*(dHp/sh))
+}
+
+func hueAngle(b, a float64) float64 {
+	if a == 0 && b == 0 {
+		return 0
+	}
+	h := math.Atan2(b, a) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+)
+
+// deep reports whether img carries more than 8 bits per channel, as 16 bit
+// PNG and TIFF files decode. Stages keep such images at 16 bits until
+// dithering.
+func deep(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA64, *image.NRGBA64, *image.Gray16:
+		return true
+	}
+	return false
+}
+
+// newCanvas returns a blank w x h image deep enough for the content of like.
+func newCanvas(like image.Image, w, h int) draw.Image {
+	if deep(like) {
+		return image.NewRGBA64(image.Rect(0, 0, w, h))
+	}
+	return image.NewRGBA(image.Rect(0, 0, w, h))
+}
+
+// channel16 reads the 16 bit big endian sample at pix[i:] as a possibly
+// fractional 8 bit value.
+func channel16(pix []byte, i int) float64 {
+	return float64(uint16(pix[i])<<8|uint16(pix[i+1])) / 257
+}
+
+// pixels returns the sample buffer, stride and bytes per pixel of a canvas
+// made by newCanvas.
+func pixels(img draw.Image) ([]byte, int, int) {
+	switch m := img.(type) {
+	case *image.RGBA64:
+		return m.Pix, m.Stride, 8
+	case *image.RGBA:
+		return m.Pix, m.Stride, 4
+	}
+	panic("pixels: not a canvas")
+}
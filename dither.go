@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ditherConfig holds the settings shared by all dithering algorithms.
+type ditherConfig struct {
+	metric    *colorMetric
+	palette   *paletteProfile
+	diffusion diffusionOptions
+}
+
+// diffusionOptions tune every error diffusion kernel.
+type diffusionOptions struct {
+	// serpentine scans odd rows right to left, mirroring the kernel
+	serpentine bool
+	// strength scales the diffused error, 1 diffusing all of it
+	strength float64
+	// limit caps the error of each channel, as a fraction of the channel's
+	// range, 0 for no cap
+	limit float64
+}
+
+var defaultDiffusion = diffusionOptions{strength: 1}
+
+func (o *diffusionOptions) validate() error {
+	if o.strength < 0 || o.strength > 1 {
+		return fmt.Errorf("diffusion strength %g is not in [0, 1]", o.strength)
+	}
+	if o.limit < 0 || o.limit > 1 {
+		return fmt.Errorf("error limit %g is not in [0, 1]", o.limit)
+	}
+	return nil
+}
+
+// scale applies strength and limit to the error e of a channel spanning span.
+func (o *diffusionOptions) scale(e, span float64) float64 {
+	e *= o.strength
+	if o.limit > 0 {
+		e = math.Max(-o.limit*span, math.Min(o.limit*span, e))
+	}
+	return e
+}
+
+// scaleInt is scale for the integer engine, exact with the defaults.
+func (o *diffusionOptions) scaleInt(e int) int {
+	if o.strength == 1 && o.limit == 0 {
+		return e
+	}
+	return int(math.Round(o.scale(float64(e), 255)))
+}
+
+// column returns the x of the i-th pixel visited in row y.
+func (o *diffusionOptions) column(i, y, width int) (int, bool) {
+	if o.serpentine && y%2 == 1 {
+		return width - 1 - i, true
+	}
+	return i, false
+}
+
+// ditherer reduces an image to the palette. Pixels of the result index the
+// palette entries in order.
+type ditherer func(img image.Image, cfg *ditherConfig) *image.Paletted
+
+// diffusionTap passes weight/divisor of the quantization error to the pixel
+// at (x+dx, y+dy).
+type diffusionTap struct {
+	dx, dy, weight int
+}
+
+// diffusionKernel is an error diffusion matrix. Taps are applied in order.
+type diffusionKernel struct {
+	divisor int
+	taps    []diffusionTap
+}
+
+var (
+	floydSteinberg = diffusionKernel{16, []diffusionTap{
+		{1, 0, 7},
+		{-1, 1, 3}, {0, 1, 5}, {1, 1, 1},
+	}}
+	falseFloydSteinberg = diffusionKernel{8, []diffusionTap{
+		{1, 0, 3},
+		{0, 1, 3}, {1, 1, 2},
+	}}
+	// atkinson only diffuses 6/8 of the error, which keeps highlights and
+	// shadows clean at the cost of detail.
+	atkinson = diffusionKernel{8, []diffusionTap{
+		{1, 0, 1}, {2, 0, 1},
+		{-1, 1, 1}, {0, 1, 1}, {1, 1, 1},
+		{0, 2, 1},
+	}}
+	jarvisJudiceNinke = diffusionKernel{48, []diffusionTap{
+		{1, 0, 7}, {2, 0, 5},
+		{-2, 1, 3}, {-1, 1, 5}, {0, 1, 7}, {1, 1, 5}, {2, 1, 3},
+		{-2, 2, 1}, {-1, 2, 3}, {0, 2, 5}, {1, 2, 3}, {2, 2, 1},
+	}}
+	stucki = diffusionKernel{42, []diffusionTap{
+		{1, 0, 8}, {2, 0, 4},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 8}, {1, 1, 4}, {2, 1, 2},
+		{-2, 2, 1}, {-1, 2, 2}, {0, 2, 4}, {1, 2, 2}, {2, 2, 1},
+	}}
+	burkes = diffusionKernel{32, []diffusionTap{
+		{1, 0, 8}, {2, 0, 4},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 8}, {1, 1, 4}, {2, 1, 2},
+	}}
+	sierra = diffusionKernel{32, []diffusionTap{
+		{1, 0, 5}, {2, 0, 3},
+		{-2, 1, 2}, {-1, 1, 4}, {0, 1, 5}, {1, 1, 4}, {2, 1, 2},
+		{-1, 2, 2}, {0, 2, 3}, {1, 2, 2},
+	}}
+	sierraTwoRow = diffusionKernel{16, []diffusionTap{
+		{1, 0, 4}, {2, 0, 3},
+		{-2, 1, 1}, {-1, 1, 2}, {0, 1, 3}, {1, 1, 2}, {2, 1, 1},
+	}}
+	sierraLite = diffusionKernel{4, []diffusionTap{
+		{1, 0, 2},
+		{-1, 1, 1}, {0, 1, 1},
+	}}
+)
+
+const defaultDither = "floyd-steinberg"
+
+var ditherers = map[string]ditherer{
+	"floyd-steinberg":       kernelDither(floydSteinberg),
+	"false-floyd-steinberg": kernelDither(falseFloydSteinberg),
+	"atkinson":              kernelDither(atkinson),
+	"jarvis-judice-ninke":   kernelDither(jarvisJudiceNinke),
+	"stucki":                kernelDither(stucki),
+	"burkes":                kernelDither(burkes),
+	"sierra":                kernelDither(sierra),
+	"sierra-two-row":        kernelDither(sierraTwoRow),
+	"sierra-lite":           kernelDither(sierraLite),
+
+	"bayer2":     thresholdDither(func() *thresholdMap { return bayerMatrix(2) }),
+	"bayer4":     thresholdDither(func() *thresholdMap { return bayerMatrix(4) }),
+	"bayer8":     thresholdDither(func() *thresholdMap { return bayerMatrix(8) }),
+	"bayer16":    thresholdDither(func() *thresholdMap { return bayerMatrix(16) }),
+	"blue-noise": thresholdDither(blueNoiseMap),
+}
+
+func ditherNames() []string {
+	names := make([]string, 0, len(ditherers))
+	for name := range ditherers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupDitherer(name string) (ditherer, error) {
+	d, ok := ditherers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dither %q, available: %s", name,
+			strings.Join(ditherNames(), ", "))
+	}
+	return d, nil
+}
+
+func kernelDither(k diffusionKernel) ditherer {
+	return func(img image.Image, cfg *ditherConfig) *image.Paletted {
+		// the integer engine works in 8 bits
+		if cfg.metric == rgbMetric && !deep(img) {
+			return errorDiffusionDither(img, k, cfg.palette, &cfg.diffusion)
+		}
+		return metricDiffusionDither(img, k, cfg.metric, cfg.palette, &cfg.diffusion)
+	}
+}
+
+// errorDiffusionDither maps every pixel to the closest palette color and
+// spreads the quantization error over the neighbours given by k. Only the
+// rows the kernel reaches are kept, as int16 channels; diffused values are
+// clamped to [0, 255] after every addition.
+func errorDiffusionDither(img image.Image, k diffusionKernel, p *paletteProfile,
+	o *diffusionOptions) *image.Paletted {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	pal := p.colors()
+	dithered := image.NewPaletted(bounds, pal)
+	lookup := rgbMetric.matcher(pal).rgb
+
+	depth := 0
+	for _, tap := range k.taps {
+		depth = max(depth, tap.dy)
+	}
+	load := rgbRows(img)
+	rows := make([][]int16, depth+1)
+	for i := range rows {
+		rows[i] = make([]int16, width*3)
+		if i < height {
+			load(i, rows[i])
+		}
+	}
+
+	// shares[t][e+255] is the part of a channel error e that tap t passes on
+	shares := make([][511]int16, len(k.taps))
+	for t, tap := range k.taps {
+		for e := -255; e <= 255; e++ {
+			shares[t][e+255] = int16(o.scaleInt(e) * tap.weight / k.divisor)
+		}
+	}
+
+	// lines[dy] is row y+dy, nil past the bottom
+	lines := make([][]int16, len(rows))
+	for y := 0; y < height; y++ {
+		for dy := range lines {
+			lines[dy] = nil
+			if y+dy < height {
+				lines[dy] = rows[(y+dy)%len(rows)]
+			}
+		}
+		row := lines[0]
+		out := dithered.Pix[y*dithered.Stride:]
+		for col := 0; col < width; col++ {
+			x, reverse := o.column(col, y, width)
+			v := row[x*3 : x*3+3]
+			idx := lookup.nearest(int(v[0]), int(v[1]), int(v[2]))
+			out[x] = uint8(idx)
+
+			target := &lookup.colors[idx]
+			errR := int(v[0]) - target[0] + 255
+			errG := int(v[1]) - target[1] + 255
+			errB := int(v[2]) - target[2] + 255
+			if errR == 255 && errG == 255 && errB == 255 {
+				continue
+			}
+
+			for t, tap := range k.taps {
+				dx := tap.dx
+				if reverse {
+					dx = -dx
+				}
+				nx, line := x+dx, lines[tap.dy]
+				if nx >= 0 && nx < width && line != nil {
+					n, share := line[nx*3:nx*3+3], &shares[t]
+					n[0] = int16(clamp(int(n[0] + share[errR])))
+					n[1] = int16(clamp(int(n[1] + share[errG])))
+					n[2] = int16(clamp(int(n[2] + share[errB])))
+				}
+			}
+		}
+
+		// the row is done, reuse it for the next one the kernel reaches
+		if next := y + len(rows); next < height {
+			load(next, row)
+		}
+	}
+	return dithered
+}
+
+// rgbRows returns a function filling dst with the 8 bit RGB channels of row
+// y of img, not premultiplied by alpha.
+func rgbRows(img image.Image) func(y int, dst []int16) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	if rgba, ok := img.(*image.RGBA); ok {
+		return func(y int, dst []int16) {
+			src := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := 0; x < width; x++ {
+				s := src[x*4 : x*4+4]
+				if s[3] != 0xff {
+					c := color.NRGBAModel.Convert(color.RGBA{s[0], s[1], s[2], s[3]}).(color.NRGBA)
+					dst[x*3], dst[x*3+1], dst[x*3+2] = int16(c.R), int16(c.G), int16(c.B)
+					continue
+				}
+				dst[x*3], dst[x*3+1], dst[x*3+2] = int16(s[0]), int16(s[1]), int16(s[2])
+			}
+		}
+	}
+
+	nrgba := image.NewNRGBA(bounds)
+	draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	return func(y int, dst []int16) {
+		src := nrgba.Pix[y*nrgba.Stride:]
+		for x := 0; x < width; x++ {
+			dst[x*3], dst[x*3+1], dst[x*3+2] = int16(src[x*4]), int16(src[x*4+1]), int16(src[x*4+2])
+		}
+	}
+}
+
+// metricDiffusionDither is errorDiffusionDither in the space of metric m:
+// pixels are converted once, and the error between a pixel and its palette
+// color is measured and diffused in that space.
+func metricDiffusionDither(img image.Image, k diffusionKernel, m *colorMetric,
+	p *paletteProfile, o *diffusionOptions) *image.Paletted {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rgba := image.NewNRGBA64(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	work := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*rgba.Stride + x*8
+			work[y*width+x] = m.toSpace(channel16(rgba.Pix, i), channel16(rgba.Pix, i+2), channel16(rgba.Pix, i+4))
+		}
+	}
+
+	pal := p.colors()
+	pm := m.matcher(pal)
+	dithered := image.NewPaletted(bounds, pal)
+
+	for y := 0; y < height; y++ {
+		for col := 0; col < width; col++ {
+			x, reverse := o.column(col, y, width)
+			old := m.clamp(work[y*width+x])
+			idx := pm.nearest(old)
+			dithered.Pix[y*dithered.Stride+x] = uint8(idx)
+
+			target := pm.colors[idx]
+			var errs [3]float64
+			for c := range errs {
+				errs[c] = o.scale(old[c]-target[c], m.hi[c]-m.lo[c])
+			}
+			for _, tap := range k.taps {
+				dx := tap.dx
+				if reverse {
+					dx = -dx
+				}
+				nx, ny := x+dx, y+tap.dy
+				if nx >= 0 && nx < width && ny >= 0 && ny < height {
+					w := float64(tap.weight) / float64(k.divisor)
+					n := &work[ny*width+nx]
+					n[0] += errs[0] * w
+					n[1] += errs[1] * w
+					n[2] += errs[2] * w
+				}
+			}
+		}
+	}
+	return dithered
+}
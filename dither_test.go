@@ -0,0 +1,244 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// referenceDiffusionDither is the original errorDiffusionDither, which
+// works on color.Color values. The fast engine must match it byte for byte.
+func referenceDiffusionDither(img image.Image, k diffusionKernel, p *paletteProfile,
+	o *diffusionOptions) *image.Paletted {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rgba := image.NewNRGBA(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	pal := p.colors()
+	dithered := image.NewPaletted(bounds, pal)
+
+	for y := 0; y < height; y++ {
+		for col := 0; col < width; col++ {
+			x, reverse := o.column(col, y, width)
+			i := y*rgba.Stride + x*4
+			oldR := int(rgba.Pix[i])
+			oldG := int(rgba.Pix[i+1])
+			oldB := int(rgba.Pix[i+2])
+			oldColor := color.RGBA{uint8(oldR), uint8(oldG), uint8(oldB), 255}
+			idx := closestColor(pal, oldColor)
+			newColor := pal[idx]
+			nr, ng, nb, _ := newColor.RGBA()
+			nr >>= 8
+			ng >>= 8
+			nb >>= 8
+			rgba.Set(x, y, newColor)
+			dithered.SetColorIndex(x, y, uint8(idx))
+
+			errR := o.scaleInt(oldR - int(nr))
+			errG := o.scaleInt(oldG - int(ng))
+			errB := o.scaleInt(oldB - int(nb))
+
+			// Diffuse the error
+			for _, tap := range k.taps {
+				dx := tap.dx
+				if reverse {
+					dx = -dx
+				}
+				nx, ny := x+dx, y+tap.dy
+				if nx >= 0 && nx < width && ny >= 0 && ny < height {
+					ni := ny*rgba.Stride + nx*4
+					rgba.Pix[ni+0] = clamp(int(rgba.Pix[ni+0]) + errR*tap.weight/k.divisor)
+					rgba.Pix[ni+1] = clamp(int(rgba.Pix[ni+1]) + errG*tap.weight/k.divisor)
+					rgba.Pix[ni+2] = clamp(int(rgba.Pix[ni+2]) + errB*tap.weight/k.divisor)
+				}
+			}
+		}
+	}
+	return dithered
+}
+
+// closestColor returns the index of the palette color with the smallest
+// squared RGB distance to c.
+func closestColor(pal color.Palette, c color.Color) int {
+	r1, g1, b1, _ := c.RGBA()
+	r1 >>= 8
+	g1 >>= 8
+	b1 >>= 8
+	minDist := uint32(1<<32 - 1)
+	var closest int
+	for i, pc := range pal {
+		r2, g2, b2, _ := pc.RGBA()
+		r2 >>= 8
+		g2 >>= 8
+		b2 >>= 8
+		// Euclidean distance (no sqrt)
+		dr := int32(r1 - r2)
+		dg := int32(g1 - g2)
+		db := int32(b1 - b2)
+		dist := uint32(dr*dr + dg*dg + db*db)
+		if dist < minDist {
+			minDist = dist
+			closest = i
+		}
+	}
+	return closest
+}
+
+var testKernels = map[string]diffusionKernel{
+	"floyd-steinberg":       floydSteinberg,
+	"false-floyd-steinberg": falseFloydSteinberg,
+	"atkinson":              atkinson,
+	"jarvis-judice-ninke":   jarvisJudiceNinke,
+	"stucki":                stucki,
+	"burkes":                burkes,
+	"sierra":                sierra,
+	"sierra-two-row":        sierraTwoRow,
+	"sierra-lite":           sierraLite,
+}
+
+// testPhoto is a deterministic stand in for a photo: smooth color ramps,
+// flat areas in palette colors and noise.
+func testPhoto(width, height int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			switch {
+			case x < width/8:
+				// flat black and white bands
+				v := uint8(255 * (y / 8 % 2))
+				img.Pix[i], img.Pix[i+1], img.Pix[i+2] = v, v, v
+			default:
+				fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+				n := rnd.Intn(41) - 20
+				img.Pix[i] = clamp(int(255*fx) + n)
+				img.Pix[i+1] = clamp(int(255*fy) + n)
+				img.Pix[i+2] = clamp(int(127+127*math.Sin(8*fx*fy)) + n)
+			}
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+func testInputs() map[string]image.Image {
+	photo := testPhoto(97, 61)
+
+	translucent := image.NewRGBA(photo.Rect)
+	copy(translucent.Pix, photo.Pix)
+	for i := 3; i < len(translucent.Pix); i += 4 * 7 {
+		a := translucent.Pix[i-3]
+		translucent.Pix[i] = a
+		for c := 1; c <= 3; c++ {
+			translucent.Pix[i-c] = uint8(int(translucent.Pix[i-c]) * int(a) / 255)
+		}
+	}
+
+	nrgba := image.NewNRGBA(photo.Rect)
+	draw.Draw(nrgba, nrgba.Rect, photo, image.Point{}, draw.Src)
+
+	ycbcr := image.NewYCbCr(photo.Rect, image.YCbCrSubsampleRatio420)
+	for y := 0; y < photo.Rect.Dy(); y++ {
+		for x := 0; x < photo.Rect.Dx(); x++ {
+			c := photo.RGBAAt(x, y)
+			ycbcr.Y[ycbcr.YOffset(x, y)], ycbcr.Cb[ycbcr.COffset(x, y)], ycbcr.Cr[ycbcr.COffset(x, y)] =
+				color.RGBToYCbCr(c.R, c.G, c.B)
+		}
+	}
+
+	return map[string]image.Image{
+		"photo":       photo,
+		"translucent": translucent,
+		"nrgba":       nrgba,
+		"ycbcr":       ycbcr,
+		"column":      testPhoto(1, 40),
+		"row":         testPhoto(40, 1),
+	}
+}
+
+func TestErrorDiffusionMatchesReference(t *testing.T) {
+	options := []diffusionOptions{
+		defaultDiffusion,
+		{serpentine: true, strength: 1},
+		{strength: 0.8},
+		{strength: 1, limit: 0.1},
+		{serpentine: true, strength: 0.5, limit: 0.25},
+	}
+	for inputName, img := range testInputs() {
+		for kernelName, k := range testKernels {
+			for _, palName := range paletteNames() {
+				p, err := lookupPalette(palName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, o := range options {
+					got := errorDiffusionDither(img, k, p, &o)
+					want := referenceDiffusionDither(img, k, p, &o)
+					if got.Rect != want.Rect {
+						t.Fatalf("%s %s %s %+v: bounds %v, want %v", inputName, kernelName, palName, o, got.Rect, want.Rect)
+					}
+					for i := range want.Pix {
+						if got.Pix[i] != want.Pix[i] {
+							t.Fatalf("%s %s %s %+v: pixel %d is %d, want %d",
+								inputName, kernelName, palName, o, i, got.Pix[i], want.Pix[i])
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRGBLookupMatchesSearch(t *testing.T) {
+	for _, palName := range paletteNames() {
+		p, err := lookupPalette(palName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newRGBLookup(p.colors())
+		for r := 0; r < 256; r++ {
+			for g := 0; g < 256; g++ {
+				for b := 0; b < 256; b++ {
+					want, wantDist := 0, math.MaxInt
+					for i, c := range l.colors {
+						dr, dg, db := r-c[0], g-c[1], b-c[2]
+						if d := dr*dr + dg*dg + db*db; d < wantDist {
+							want, wantDist = i, d
+						}
+					}
+					if got := l.nearest(r, g, b); got != want {
+						t.Fatalf("%s: nearest(%d, %d, %d) = %d, want %d", palName, r, g, b, got, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func benchmarkDiffusion(b *testing.B, dither func(image.Image, diffusionKernel, *paletteProfile, *diffusionOptions) *image.Paletted) {
+	img := testPhoto(800, 480)
+	for _, palName := range []string{"acep7", "spectra6-measured"} {
+		p, err := lookupPalette(palName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(palName, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				dither(img, floydSteinberg, p, &defaultDiffusion)
+			}
+		})
+	}
+}
+
+func BenchmarkErrorDiffusion(b *testing.B) {
+	benchmarkDiffusion(b, errorDiffusionDither)
+}
+
+func BenchmarkReferenceDiffusion(b *testing.B) {
+	benchmarkDiffusion(b, referenceDiffusionDither)
+}
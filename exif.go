@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exifInfo holds the EXIF fields the converter uses.
+type exifInfo struct {
+	// orientation is the TIFF Orientation tag, 1 (upright) to 8
+	orientation int
+	captured    time.Time
+}
+
+const (
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// jpegMetadata is what readJPEGMetadata collects from the segments before
+// the image data.
+type jpegMetadata struct {
+	exif *exifInfo
+	// exifErr is why a malformed EXIF segment was dropped
+	exifErr error
+	// icc is the embedded ICC profile, reassembled from its APP2 chunks
+	icc []byte
+	// iccErr is why an incomplete profile was dropped
+	iccErr error
+}
+
+// readJPEGMetadata returns the EXIF data and ICC profile of a JPEG stream,
+// either nil if missing.
+func readJPEGMetadata(r io.Reader) (*jpegMetadata, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil {
+		return nil, err
+	}
+	if soi != [2]byte{0xFF, 0xD8} {
+		return nil, errors.New("not a JPEG stream")
+	}
+
+	meta := &jpegMetadata{}
+	iccChunks := map[byte][]byte{}
+	var iccCount byte
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if marker != 0xFF {
+			return nil, errors.Errorf("bad JPEG marker 0x%02x", marker)
+		}
+		kind, err := br.ReadByte()
+		for err == nil && kind == 0xFF {
+			kind, err = br.ReadByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		// metadata segments all come before the scan
+		if kind == 0xDA || kind == 0xD9 {
+			break
+		}
+		if kind == 0x01 || kind >= 0xD0 && kind <= 0xD7 {
+			continue
+		}
+
+		var size [2]byte
+		if _, err := io.ReadFull(br, size[:]); err != nil {
+			return nil, err
+		}
+		n := int(binary.BigEndian.Uint16(size[:])) - 2
+		if n < 0 {
+			return nil, errors.New("bad JPEG segment length")
+		}
+		segment := make([]byte, n)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return nil, err
+		}
+		switch {
+		case kind == 0xE1 && meta.exif == nil && meta.exifErr == nil && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			// EXIF is optional, a broken segment only loses the orientation
+			meta.exif, meta.exifErr = parseExif(segment[6:])
+		case kind == 0xE2 && len(segment) > 14 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")):
+			// chunks are numbered from 1 and carry the total count
+			iccChunks[segment[12]] = segment[14:]
+			iccCount = segment[13]
+		}
+	}
+
+	for i := byte(1); iccCount > 0 && i <= iccCount; i++ {
+		chunk, ok := iccChunks[i]
+		if !ok {
+			meta.icc, meta.iccErr = nil, errors.Errorf("ICC profile chunk %d of %d missing", i, iccCount)
+			break
+		}
+		meta.icc = append(meta.icc, chunk...)
+	}
+	return meta, nil
+}
+
+// parseExif reads a TIFF structure as embedded in an APP1 segment.
+func parseExif(data []byte) (*exifInfo, error) {
+	if len(data) < 8 {
+		return nil, errors.New("EXIF data too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("bad EXIF byte order")
+	}
+
+	info := &exifInfo{orientation: 1}
+	var dateTime string
+	var exifIFD uint32
+	err := readIFD(data, order, order.Uint32(data[4:]), func(tag, typ uint16, count uint32, value []byte) {
+		switch tag {
+		case tagOrientation:
+			if typ == 3 && count == 1 {
+				if o := int(order.Uint16(value)); o >= 1 && o <= 8 {
+					info.orientation = o
+				}
+			}
+		case tagDateTime:
+			dateTime = exifString(data, order, typ, count, value)
+		case tagExifIFD:
+			exifIFD = order.Uint32(value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if exifIFD != 0 {
+		err = readIFD(data, order, exifIFD, func(tag, typ uint16, count uint32, value []byte) {
+			if tag == tagDateTimeOriginal {
+				dateTime = exifString(data, order, typ, count, value)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t, err := time.ParseInLocation("2006:01:02 15:04:05", dateTime, time.Local); err == nil {
+		info.captured = t
+	}
+	return info, nil
+}
+
+// readIFD calls fn with the raw 4 byte value field of every entry.
+func readIFD(data []byte, order binary.ByteOrder, offset uint32,
+	fn func(tag, typ uint16, count uint32, value []byte)) error {
+	if uint64(offset)+2 > uint64(len(data)) {
+		return errors.New("EXIF IFD out of range")
+	}
+	n := int(order.Uint16(data[offset:]))
+	entries := data[offset+2:]
+	if len(entries) < n*12 {
+		return errors.New("EXIF IFD truncated")
+	}
+	for i := 0; i < n; i++ {
+		e := entries[i*12:]
+		fn(order.Uint16(e), order.Uint16(e[2:]), order.Uint32(e[4:]), e[8:12])
+	}
+	return nil
+}
+
+func exifString(data []byte, order binary.ByteOrder, typ uint16, count uint32, value []byte) string {
+	if typ != 2 {
+		return ""
+	}
+	s := value
+	if count > 4 {
+		offset := order.Uint32(value)
+		if uint64(offset)+uint64(count) > uint64(len(data)) {
+			return ""
+		}
+		s = data[offset : offset+count]
+	} else {
+		s = s[:count]
+	}
+	return strings.TrimRight(string(s), "\x00 ")
+}
+
+// applyOrientation turns img upright as EXIF orientation o describes.
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	src := newCanvas(img, w, h)
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	srcPix, srcStride, bpp := pixels(src)
+
+	dstW, dstH := w, h
+	if o >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := newCanvas(img, dstW, dstH)
+	dstPix, dstStride, _ := pixels(dst)
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch o {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // turned 90 degrees counterclockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned 90 degrees clockwise
+				sx, sy = w-1-y, x
+			}
+			d := y*dstStride + x*bpp
+			copy(dstPix[d:d+bpp], srcPix[sy*srcStride+sx*bpp:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// exifEntry is an IFD entry of a test EXIF block. SHORT values go in the
+// first two bytes of the value field, everything else fills all four.
+type exifEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    uint32
+}
+
+// exifOrder writes the fields of test EXIF blocks.
+type exifOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+var exifOrders = []exifOrder{binary.LittleEndian, binary.BigEndian}
+
+// buildIFD encodes entries as an IFD without a next one.
+func buildIFD(order exifOrder, entries []exifEntry) []byte {
+	b := order.AppendUint16(nil, uint16(len(entries)))
+	for _, e := range entries {
+		b = order.AppendUint16(b, e.tag)
+		b = order.AppendUint16(b, e.typ)
+		b = order.AppendUint32(b, e.count)
+		if e.typ == 3 {
+			b = append(order.AppendUint16(b, uint16(e.value)), 0, 0)
+		} else {
+			b = order.AppendUint32(b, e.value)
+		}
+	}
+	return order.AppendUint32(b, 0)
+}
+
+// buildExif lays out a TIFF header pointing at ifdOffset, IFD0 with entries
+// at offset 8, and then tail.
+func buildExif(order exifOrder, ifdOffset uint32, entries []exifEntry, tail []byte) []byte {
+	b := []byte("MM")
+	if order == binary.LittleEndian {
+		b = []byte("II")
+	}
+	b = order.AppendUint16(b, 42)
+	b = order.AppendUint32(b, ifdOffset)
+	b = append(b, buildIFD(order, entries)...)
+	return append(b, tail...)
+}
+
+func orientationExif(order exifOrder, o int) []byte {
+	return buildExif(order, 8, []exifEntry{{tagOrientation, 3, 1, uint32(o)}}, nil)
+}
+
+// orientationImage is 3x2 with the red channel of the pixels numbered
+//
+//	1 2 3
+//	4 5 6
+func orientationImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		img.Set(i%3, i/3, color.RGBA{uint8(i + 1), 0, 0, 255})
+	}
+	return img
+}
+
+func redRows(img image.Image) [][]uint8 {
+	bounds := img.Bounds()
+	var rows [][]uint8
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		var row []uint8
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			row = append(row, uint8(r>>8))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestParseExifOrientation(t *testing.T) {
+	// how orientationImage looks once turned upright
+	upright := map[int][][]uint8{
+		1: {{1, 2, 3}, {4, 5, 6}},
+		2: {{3, 2, 1}, {6, 5, 4}},
+		3: {{6, 5, 4}, {3, 2, 1}},
+		4: {{4, 5, 6}, {1, 2, 3}},
+		5: {{1, 4}, {2, 5}, {3, 6}},
+		6: {{4, 1}, {5, 2}, {6, 3}},
+		7: {{6, 3}, {5, 2}, {4, 1}},
+		8: {{3, 6}, {2, 5}, {1, 4}},
+	}
+	for _, order := range exifOrders {
+		for o := 1; o <= 8; o++ {
+			info, err := parseExif(orientationExif(order, o))
+			if err != nil {
+				t.Fatalf("%v orientation %d: %v", order, o, err)
+			}
+			if info.orientation != o {
+				t.Errorf("%v: parsed orientation %d, want %d", order, info.orientation, o)
+			}
+			if got := redRows(applyOrientation(orientationImage(), info.orientation)); !reflect.DeepEqual(got, upright[o]) {
+				t.Errorf("%v orientation %d: got %v, want %v", order, o, got, upright[o])
+			}
+		}
+	}
+}
+
+func TestParseExifIgnoresBadOrientation(t *testing.T) {
+	for _, entry := range []exifEntry{
+		{tagOrientation, 3, 1, 0},
+		{tagOrientation, 3, 1, 9},
+		{tagOrientation, 4, 1, 6},
+		{tagOrientation, 3, 2, 6},
+	} {
+		info, err := parseExif(buildExif(binary.BigEndian, 8, []exifEntry{entry}, nil))
+		if err != nil {
+			t.Fatalf("%+v: %v", entry, err)
+		}
+		if info.orientation != 1 {
+			t.Errorf("%+v: orientation %d, want 1", entry, info.orientation)
+		}
+	}
+}
+
+func TestParseExifDate(t *testing.T) {
+	const (
+		dateTime = "2020:01:02 03:04:05\x00"
+		original = "2019:06:07 08:09:10\x00"
+	)
+	for _, order := range exifOrders {
+		// IFD0 with two entries is 30 bytes from 8, the strings and the
+		// EXIF IFD follow it
+		ifd0End := uint32(8 + 2 + 2*12 + 4)
+		exifIFD := ifd0End + uint32(len(dateTime))
+		originalAt := exifIFD + 2 + 12 + 4
+		tail := append([]byte(dateTime), buildIFD(order, []exifEntry{{tagDateTimeOriginal, 2, 20, originalAt}})...)
+		tail = append(tail, original...)
+		data := buildExif(order, 8, []exifEntry{
+			{tagDateTime, 2, 20, ifd0End},
+			{tagExifIFD, 4, 1, exifIFD},
+		}, tail)
+
+		info, err := parseExif(data)
+		if err != nil {
+			t.Fatalf("%v: %v", order, err)
+		}
+		want := time.Date(2019, 6, 7, 8, 9, 10, 0, time.Local)
+		if !info.captured.Equal(want) {
+			t.Errorf("%v: captured %v, want the original date %v", order, info.captured, want)
+		}
+
+		// a string pointing past the end is ignored, not an error
+		data = buildExif(order, 8, []exifEntry{{tagDateTime, 2, 20, 4000}}, nil)
+		if info, err = parseExif(data); err != nil || !info.captured.IsZero() {
+			t.Errorf("%v: out of range date gave %v, %v", order, info, err)
+		}
+	}
+}
+
+func TestParseExifErrors(t *testing.T) {
+	for _, order := range exifOrders {
+		truncated := orientationExif(order, 6)
+		// claim three entries but keep only the first
+		order.PutUint16(truncated[8:], 3)
+		truncated = truncated[:8+2+12]
+
+		for _, tc := range []struct {
+			name string
+			data []byte
+		}{
+			{"empty", nil},
+			{"short header", []byte("II*\x00")},
+			{"bad byte order", append([]byte("XY"), orientationExif(order, 6)[2:]...)},
+			{"IFD offset past the end", buildExif(order, 4000, nil, nil)},
+			{"IFD offset overflowing", buildExif(order, 0xffffffff, nil, nil)},
+			{"IFD count past the end", buildExif(order, uint32(len(buildExif(order, 8, nil, nil))-1), nil, nil)},
+			{"truncated IFD", truncated},
+			{"EXIF IFD past the end", buildExif(order, 8, []exifEntry{{tagExifIFD, 4, 1, 4000}}, nil)},
+		} {
+			if info, err := parseExif(tc.data); err == nil {
+				t.Errorf("%v %s: parsed %+v, want an error", order, tc.name, info)
+			}
+		}
+	}
+}
+
+// jpegSegment encodes a marker segment with its length.
+func jpegSegment(kind byte, payload []byte) []byte {
+	return append([]byte{0xFF, kind, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+func exifSegment(data []byte) []byte {
+	return jpegSegment(0xE1, append([]byte("Exif\x00\x00"), data...))
+}
+
+func iccSegment(seq, count byte, data string) []byte {
+	return jpegSegment(0xE2, append([]byte{'I', 'C', 'C', '_', 'P', 'R', 'O', 'F', 'I', 'L', 'E', 0, seq, count}, data...))
+}
+
+// jpegStream joins segments between the start of image and a start of scan.
+func jpegStream(segments ...[]byte) []byte {
+	b := []byte{0xFF, 0xD8}
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, jpegSegment(0xDA, []byte{0})...)
+}
+
+func TestReadJPEGMetadata(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		stream      []byte
+		orientation int // 0 for no EXIF
+		icc         string
+		exifErr     bool
+		iccErr      bool
+	}{
+		{name: "none", stream: jpegStream()},
+		{name: "other segments", stream: jpegStream(jpegSegment(0xE0, []byte("JFIF\x00")), jpegSegment(0xFE, []byte("comment")))},
+		{name: "exif little endian", stream: jpegStream(exifSegment(orientationExif(binary.LittleEndian, 6))), orientation: 6},
+		{name: "exif big endian", stream: jpegStream(exifSegment(orientationExif(binary.BigEndian, 8))), orientation: 8},
+		{name: "first exif wins", stream: jpegStream(
+			exifSegment(orientationExif(binary.BigEndian, 3)),
+			exifSegment(orientationExif(binary.BigEndian, 6))), orientation: 3},
+		{name: "fill bytes", stream: append([]byte{0xFF, 0xD8, 0xFF, 0xFF}, jpegStream(exifSegment(orientationExif(binary.BigEndian, 2)))[2:]...), orientation: 2},
+		{name: "whole profile", stream: jpegStream(iccSegment(1, 1, "profile")), icc: "profile"},
+		{name: "split profile", stream: jpegStream(iccSegment(1, 3, "ab"), iccSegment(2, 3, "cd"), iccSegment(3, 3, "ef")), icc: "abcdef"},
+		{name: "profile out of order", stream: jpegStream(iccSegment(2, 2, "cd"), iccSegment(1, 2, "ab")), icc: "abcd"},
+		{name: "profile chunk missing", stream: jpegStream(iccSegment(1, 3, "ab"), iccSegment(3, 3, "ef")), iccErr: true},
+		{name: "malformed exif keeps the profile", stream: jpegStream(
+			exifSegment([]byte("XX*\x00\x08\x00\x00\x00")), iccSegment(1, 1, "profile")), exifErr: true, icc: "profile"},
+		{name: "truncated exif", stream: jpegStream(exifSegment(orientationExif(binary.BigEndian, 6)[:12])), exifErr: true},
+	} {
+		meta, err := readJPEGMetadata(bytes.NewReader(tc.stream))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		orientation := 0
+		if meta.exif != nil {
+			orientation = meta.exif.orientation
+		}
+		if orientation != tc.orientation {
+			t.Errorf("%s: orientation %d, want %d", tc.name, orientation, tc.orientation)
+		}
+		if string(meta.icc) != tc.icc {
+			t.Errorf("%s: profile %q, want %q", tc.name, meta.icc, tc.icc)
+		}
+		if (meta.exifErr != nil) != tc.exifErr || (meta.iccErr != nil) != tc.iccErr {
+			t.Errorf("%s: EXIF error %v, profile error %v", tc.name, meta.exifErr, meta.iccErr)
+		}
+	}
+}
+
+func TestReadJPEGMetadataErrors(t *testing.T) {
+	whole := jpegStream(exifSegment(orientationExif(binary.BigEndian, 6)))
+	for _, tc := range []struct {
+		name   string
+		stream []byte
+	}{
+		{"empty", nil},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n")},
+		{"no marker", []byte{0xFF, 0xD8, 0x00}},
+		{"bad segment length", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}},
+		{"truncated segment", whole[:len(whole)-10]},
+		{"no scan", whole[:len(whole)-5]},
+	} {
+		if meta, err := readJPEGMetadata(bytes.NewReader(tc.stream)); err == nil {
+			t.Errorf("%s: read %+v, want an error", tc.name, meta)
+		}
+	}
+}
+
+func FuzzParseExif(f *testing.F) {
+	for _, order := range exifOrders {
+		f.Add(orientationExif(order, 6))
+		f.Add(buildExif(order, 8, []exifEntry{{tagDateTime, 2, 20, 26}, {tagExifIFD, 4, 1, 8}}, []byte("2020:01:02 03:04:05\x00")))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := parseExif(data)
+		if err != nil {
+			return
+		}
+		if info.orientation < 1 || info.orientation > 8 {
+			t.Fatalf("orientation %d out of range", info.orientation)
+		}
+		if len(data) > 0xff00 {
+			return
+		}
+		// whatever parses also parses out of a JPEG stream
+		meta, err := readJPEGMetadata(bytes.NewReader(jpegStream(exifSegment(data))))
+		if err != nil || meta.exifErr != nil || meta.exif.orientation != info.orientation {
+			t.Fatalf("wrapped in a JPEG stream: %+v, %v", meta, err)
+		}
+	})
+}
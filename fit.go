@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	fitStretch = "stretch"
+	fitContain = "contain"
+	fitCover   = "cover"
+	fitSmart   = "smart"
+)
+
+var fitModes = []string{fitStretch, fitContain, fitCover, fitSmart}
+
+// fitOptions says how the source is mapped onto the panel.
+type fitOptions struct {
+	mode string
+	// background fills the letterbox bars of contain
+	background paletteEntry
+	// focus is the point cover keeps in view, as fractions of the source
+	focusX, focusY float64
+}
+
+// parseFit checks that mode is one of fitModes.
+func parseFit(mode string) (string, error) {
+	for _, m := range fitModes {
+		if m == mode {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("unknown fit %q, available: %s", mode, strings.Join(fitModes, ", "))
+}
+
+// parseCrop parses "x,y,w,h" into a rectangle of pixels.
+func parseCrop(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("crop %q is not x,y,w,h", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return image.Rectangle{}, fmt.Errorf("crop %q is not x,y,w,h", s)
+		}
+		v[i] = n
+	}
+	if v[2] <= 0 || v[3] <= 0 {
+		return image.Rectangle{}, fmt.Errorf("crop %q has an empty size", s)
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// parseFocus parses "x,y", both fractions in [0, 1].
+func parseFocus(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("focus %q is not x,y", s)
+	}
+	var v [2]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || !(f >= 0 && f <= 1) {
+			return 0, 0, fmt.Errorf("focus %q is not x,y with both in [0, 1]", s)
+		}
+		v[i] = f
+	}
+	return v[0], v[1], nil
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// cropImage returns the part of src inside r, which is relative to the top
+// left corner of src.
+func cropImage(src image.Image, r image.Rectangle) (image.Image, error) {
+	bounds := src.Bounds()
+	r = r.Add(bounds.Min)
+	if !r.In(bounds) {
+		return nil, fmt.Errorf("crop %dx%d+%d+%d is outside the %dx%d image",
+			r.Dx(), r.Dy(), r.Min.X-bounds.Min.X, r.Min.Y-bounds.Min.Y, bounds.Dx(), bounds.Dy())
+	}
+	if s, ok := src.(subImager); ok {
+		return s.SubImage(r), nil
+	}
+	dst := newCanvas(src, r.Dx(), r.Dy())
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst, nil
+}
+
+// fitImage scales src to width x height with filter f as opts.mode says.
+// Contain keeps the aspect ratio and may return less, letterbox pads that.
+func fitImage(src image.Image, width, height int, f *resampleFilter, opts *fitOptions) (image.Image, error) {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	switch opts.mode {
+	case fitStretch, "":
+		return f.resample(src, width, height), nil
+
+	case fitContain:
+		scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+		w := max(1, min(width, int(math.Round(float64(srcW)*scale))))
+		h := max(1, min(height, int(math.Round(float64(srcH)*scale))))
+		return f.resample(src, w, h), nil
+
+	case fitCover, fitSmart:
+		// the largest window of the panel's aspect ratio
+		winW, winH := srcW, srcH
+		if srcW*height > srcH*width {
+			winW = max(1, int(math.Round(float64(srcH)*float64(width)/float64(height))))
+		} else {
+			winH = max(1, int(math.Round(float64(srcW)*float64(height)/float64(width))))
+		}
+
+		var x, y int
+		if opts.mode == fitSmart {
+			x, y = smartWindow(src, winW, winH)
+		} else {
+			x = int(math.Round(opts.focusX*float64(srcW) - float64(winW)/2))
+			y = int(math.Round(opts.focusY*float64(srcH) - float64(winH)/2))
+		}
+		x = max(0, min(srcW-winW, x))
+		y = max(0, min(srcH-winH, y))
+
+		window, err := cropImage(src, image.Rect(x, y, x+winW, y+winH))
+		if err != nil {
+			return nil, err
+		}
+		return f.resample(window, width, height), nil
+	}
+	return nil, fmt.Errorf("unknown fit %q, available: %s", opts.mode, strings.Join(fitModes, ", "))
+}
+
+// letterbox centers img on a width x height canvas of the contain
+// background, or returns it as is when it fills the canvas already.
+func letterbox(img image.Image, width, height int, opts *fitOptions) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == width && h == height {
+		return img
+	}
+	dst := newCanvas(img, width, height)
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(opts.background.color), image.Point{}, draw.Src)
+	at := image.Pt((width-w)/2, (height-h)/2)
+	draw.Draw(dst, image.Rectangle{at, at.Add(image.Pt(w, h))}, img, bounds.Min, draw.Src)
+	return dst
+}
+
+// saliencySize is the long side of the thumbnail smartWindow scores.
+const saliencySize = 256
+
+// smartWindow places a winW x winH window, which spans src along one axis,
+// where it covers the most detail: the sum of the luminance gradient
+// magnitudes, weighted towards the center so flat images stay centered.
+func smartWindow(src image.Image, winW, winH int) (int, int) {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	scale := math.Min(1, saliencySize/float64(max(srcW, srcH)))
+	w, h := max(1, int(float64(srcW)*scale)), max(1, int(float64(srcH)*scale))
+
+	lum := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x*srcW/w, bounds.Min.Y+y*srcH/h).RGBA()
+			lum[y*w+x] = (0.2126*float64(r) + 0.7152*float64(g) + 0.0722*float64(b)) / 0xffff
+		}
+	}
+
+	horizontal := winW < srcW
+	n := h
+	if horizontal {
+		n = w
+	}
+	// detail per column (or row) of the thumbnail
+	profile := make([]float64, n)
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			gx := lum[y*w+x+1] - lum[y*w+x-1]
+			gy := lum[(y+1)*w+x] - lum[(y-1)*w+x]
+			if horizontal {
+				profile[x] += math.Hypot(gx, gy)
+			} else {
+				profile[y] += math.Hypot(gx, gy)
+			}
+		}
+	}
+
+	win := int(math.Round(float64(winH) * scale))
+	if horizontal {
+		win = int(math.Round(float64(winW) * scale))
+	}
+	win = max(1, min(n, win))
+
+	center := float64(n-win) / 2
+	best, bestScore := (n-win)/2, math.Inf(-1)
+	var sum float64
+	for i := 0; i < n; i++ {
+		sum += profile[i]
+		if i >= win {
+			sum -= profile[i-win]
+		}
+		if i < win-1 {
+			continue
+		}
+		start := i - win + 1
+		offCenter := math.Abs(float64(start)-center) / float64(n)
+		score := sum * (1 - 0.5*offCenter)
+		// ties, such as all the windows of a flat image, go to the center
+		if score > bestScore || score == bestScore && offCenter < math.Abs(float64(best)-center)/float64(n) {
+			best, bestScore = start, score
+		}
+	}
+
+	if horizontal {
+		return int(float64(best) / scale), 0
+	}
+	return 0, int(float64(best) / scale)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseFit(t *testing.T) {
+	for _, mode := range fitModes {
+		if got, err := parseFit(mode); err != nil || got != mode {
+			t.Errorf("%q: got %q, %v", mode, got, err)
+		}
+	}
+	for _, mode := range []string{"", "nope", "Contain"} {
+		if _, err := parseFit(mode); err == nil {
+			t.Errorf("%q: expected an error", mode)
+		}
+	}
+	// before any file is read, so a batch fails once instead of per file
+	if _, err := newConversion(imgContext(t, "--fit", "nope")); err == nil {
+		t.Error("newConversion accepted --fit nope")
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want image.Rectangle
+	}{
+		{"0,0,10,20", image.Rect(0, 0, 10, 20)},
+		{"5, 6, 7, 8", image.Rect(5, 6, 12, 14)},
+		{"-2,3,4,5", image.Rect(-2, 3, 2, 8)},
+	} {
+		if got, err := parseCrop(tc.s); err != nil || got != tc.want {
+			t.Errorf("%q: got %v, %v, want %v", tc.s, got, err, tc.want)
+		}
+	}
+	for _, s := range []string{"", "1,2,3", "1,2,3,4,5", "a,2,3,4", "1,2,0,4", "1,2,3,-4", "1.5,2,3,4"} {
+		if r, err := parseCrop(s); err == nil {
+			t.Errorf("%q: parsed %v, want an error", s, r)
+		}
+	}
+}
+
+func TestParseFocus(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		x, y float64
+	}{
+		{"0.5,0.5", 0.5, 0.5},
+		{"0,1", 0, 1},
+		{" 0.25 , 0.75 ", 0.25, 0.75},
+	} {
+		if x, y, err := parseFocus(tc.s); err != nil || x != tc.x || y != tc.y {
+			t.Errorf("%q: got %g,%g, %v, want %g,%g", tc.s, x, y, err, tc.x, tc.y)
+		}
+	}
+	for _, s := range []string{"", "0.5", "0.5,0.5,0.5", "x,0.5", "-0.1,0.5", "0.5,1.1", "NaN,0.5"} {
+		if x, y, err := parseFocus(s); err == nil {
+			t.Errorf("%q: parsed %g,%g, want an error", s, x, y)
+		}
+	}
+}
+
+// detailImage is a flat gray w x h image with a checkerboard in r.
+func detailImage(w, h int, r image.Rectangle) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(128)
+			if image.Pt(x, y).In(r) {
+				v = uint8((x/4+y/4)%2) * 255
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestSmartWindow(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		src        image.Image
+		winW, winH int
+		// the window start along its free axis must be in [min, max]
+		min, max int
+	}{
+		{"flat wide stays centered", detailImage(300, 100, image.Rectangle{}), 100, 100, 95, 105},
+		{"flat tall stays centered", detailImage(100, 300, image.Rectangle{}), 100, 100, 95, 105},
+		{"detail on the right", detailImage(300, 100, image.Rect(220, 0, 290, 100)), 100, 100, 190, 200},
+		{"detail on the left", detailImage(300, 100, image.Rect(10, 0, 80, 100)), 100, 100, 0, 10},
+		{"detail at the top", detailImage(100, 300, image.Rect(0, 10, 100, 60)), 100, 100, 0, 10},
+		{"detail in a large image", detailImage(1200, 300, image.Rect(900, 0, 1150, 300)), 300, 300, 850, 900},
+	} {
+		x, y := smartWindow(tc.src, tc.winW, tc.winH)
+		free, fixed := x, y
+		if tc.winW == tc.src.Bounds().Dx() {
+			free, fixed = y, x
+		}
+		if fixed != 0 || free < tc.min || free > tc.max {
+			t.Errorf("%s: window at %d,%d, want %d to %d along the free axis", tc.name, x, y, tc.min, tc.max)
+		}
+	}
+}
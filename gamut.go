@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// gamutSteps is the number of lookup table nodes per sRGB channel.
+const gamutSteps = 33
+
+// gamutMapper pulls colors toward the gamut the palette can reproduce by
+// dithering: the convex hull of the palette colors in Oklab. Colors inside
+// stay put; colors outside move towards their nearest point on the hull by
+// strength, 1 putting them on it. Error diffusion then no longer chases
+// targets it can never reach.
+type gamutMapper struct {
+	// lut holds the mapped sRGB color of each node of an sRGB grid
+	lut []uint8
+}
+
+func newGamutMapper(pal color.Palette, strength float64) (*gamutMapper, error) {
+	if !(strength >= 0 && strength <= 1) {
+		return nil, fmt.Errorf("gamut mapping strength %g is not in [0, 1]", strength)
+	}
+	points := make([][3]float64, len(pal))
+	for i, c := range pal {
+		r, g, b, _ := c.RGBA()
+		points[i] = srgbToOklab(float64(r>>8), float64(g>>8), float64(b>>8))
+	}
+	subsets := affineSubsets(len(points))
+
+	gm := &gamutMapper{lut: make([]uint8, gamutSteps*gamutSteps*gamutSteps*3)}
+	step := 255.0 / (gamutSteps - 1)
+	i := 0
+	for r := 0; r < gamutSteps; r++ {
+		for g := 0; g < gamutSteps; g++ {
+			for b := 0; b < gamutSteps; b++ {
+				x := srgbToOklab(float64(r)*step, float64(g)*step, float64(b)*step)
+				p := hullProjection(points, subsets, x)
+				for k := range x {
+					x[k] += strength * (p[k] - x[k])
+				}
+				lr, lg, lb := oklabToLinear(x)
+				gm.lut[i] = linearToSRGB(lr)
+				gm.lut[i+1] = linearToSRGB(lg)
+				gm.lut[i+2] = linearToSRGB(lb)
+				i += 3
+			}
+		}
+	}
+	return gm, nil
+}
+
+// apply maps every pixel of img, interpolating the table trilinearly.
+func (gm *gamutMapper) apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+
+	const scale = float64(gamutSteps-1) / 255
+	cell := func(v uint8) (int, float64) {
+		f := float64(v) * scale
+		i := min(gamutSteps-2, int(f))
+		return i, f - float64(i)
+	}
+	node := func(r, g, b int) int {
+		return ((r*gamutSteps+g)*gamutSteps + b) * 3
+	}
+
+	pix := dst.Pix
+	for p := 0; p < len(pix); p += 4 {
+		r, fr := cell(pix[p])
+		g, fg := cell(pix[p+1])
+		b, fb := cell(pix[p+2])
+		for c := 0; c < 3; c++ {
+			v := 0.0
+			for corner := 0; corner < 8; corner++ {
+				dr, dg, db := corner>>2&1, corner>>1&1, corner&1
+				w := lerpWeight(fr, dr) * lerpWeight(fg, dg) * lerpWeight(fb, db)
+				v += w * float64(gm.lut[node(r+dr, g+dg, b+db)+c])
+			}
+			pix[p+c] = clamp(int(v + 0.5))
+		}
+	}
+	return dst
+}
+
+func lerpWeight(f float64, upper int) float64 {
+	if upper == 1 {
+		return f
+	}
+	return 1 - f
+}
+
+// affineSubsets lists the subsets of 1 to 4 of n points, each as indices.
+// The nearest point of a convex hull in 3D lies in the convex hull of one of
+// them.
+func affineSubsets(n int) [][]int {
+	var subsets [][]int
+	var pick func(start int, cur []int)
+	pick = func(start int, cur []int) {
+		if len(cur) > 0 {
+			subsets = append(subsets, append([]int{}, cur...))
+		}
+		if len(cur) == 4 {
+			return
+		}
+		for i := start; i < n; i++ {
+			pick(i+1, append(cur, i))
+		}
+	}
+	pick(0, nil)
+	return subsets
+}
+
+// hullProjection returns the point of the convex hull of points nearest to
+// x, trying the projection onto the affine hull of every subset and keeping
+// the nearest one that falls inside the subset's simplex.
+func hullProjection(points [][3]float64, subsets [][]int, x [3]float64) [3]float64 {
+	best, bestDist := x, math.Inf(1)
+	for _, s := range subsets {
+		p, ok := simplexProjection(points, s, x)
+		if !ok {
+			continue
+		}
+		if d := squaredDistance(p, x); d < bestDist {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
+
+func simplexProjection(points [][3]float64, s []int, x [3]float64) ([3]float64, bool) {
+	p0 := points[s[0]]
+	k := len(s) - 1
+	if k == 0 {
+		return p0, true
+	}
+
+	var d [3][3]float64
+	for j := 0; j < k; j++ {
+		for c := 0; c < 3; c++ {
+			d[j][c] = points[s[j+1]][c] - p0[c]
+		}
+	}
+	// normal equations: G t = rhs with G the Gram matrix of the edges
+	var m [3][4]float64
+	for i := 0; i < k; i++ {
+		for j := 0; j < k; j++ {
+			m[i][j] = dot3(d[i], d[j])
+		}
+		m[i][k] = dot3(d[i], [3]float64{x[0] - p0[0], x[1] - p0[1], x[2] - p0[2]})
+	}
+	for col := 0; col < k; col++ {
+		pivot := col
+		for r := col + 1; r < k; r++ {
+			if math.Abs(m[r][col]) > math.Abs(m[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-12 {
+			return x, false // the points are not affinely independent
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		for r := 0; r < k; r++ {
+			if r == col {
+				continue
+			}
+			f := m[r][col] / m[col][col]
+			for c := col; c <= k; c++ {
+				m[r][c] -= f * m[col][c]
+			}
+		}
+	}
+
+	p := p0
+	sum := 0.0
+	for j := 0; j < k; j++ {
+		t := m[j][k] / m[j][j]
+		if t < -1e-9 {
+			return x, false
+		}
+		sum += t
+		for c := 0; c < 3; c++ {
+			p[c] += t * d[j][c]
+		}
+	}
+	if sum > 1+1e-9 {
+		return x, false
+	}
+	return p, true
+}
+
+func dot3(a, b [3]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
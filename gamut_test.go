@@ -0,0 +1,200 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestAffineSubsets(t *testing.T) {
+	// C(n,1) + C(n,2) + C(n,3) + C(n,4)
+	for n, want := range map[int]int{1: 1, 2: 3, 4: 15, 7: 98} {
+		if got := len(affineSubsets(n)); got != want {
+			t.Errorf("%d points: %d subsets, want %d", n, got, want)
+		}
+	}
+}
+
+func TestHullProjection(t *testing.T) {
+	var cube [][3]float64
+	for i := 0; i < 8; i++ {
+		cube = append(cube, [3]float64{float64(i >> 2 & 1), float64(i >> 1 & 1), float64(i & 1)})
+	}
+	subsets := affineSubsets(len(cube))
+	for _, tc := range []struct {
+		x, want [3]float64
+	}{
+		{[3]float64{0.3, 0.6, 0.9}, [3]float64{0.3, 0.6, 0.9}},
+		{[3]float64{1, 0, 0.5}, [3]float64{1, 0, 0.5}},
+		{[3]float64{2, 0.5, 0.5}, [3]float64{1, 0.5, 0.5}},
+		{[3]float64{1.5, -1, 0.5}, [3]float64{1, 0, 0.5}},
+		{[3]float64{2, 2, 2}, [3]float64{1, 1, 1}},
+		{[3]float64{-0.5, 0.25, 3}, [3]float64{0, 0.25, 1}},
+	} {
+		if got := hullProjection(cube, subsets, tc.x); squaredDistance(got, tc.want) > 1e-18 {
+			t.Errorf("%v projected to %v, want %v", tc.x, got, tc.want)
+		}
+	}
+}
+
+// onHull reports whether p is the point of the hull of points nearest to x:
+// no vertex lies beyond the plane through p facing x.
+func onHull(points [][3]float64, x, p [3]float64) bool {
+	r := [3]float64{x[0] - p[0], x[1] - p[1], x[2] - p[2]}
+	for _, v := range points {
+		if dot3(r, [3]float64{v[0] - p[0], v[1] - p[1], v[2] - p[2]}) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// oklabPoints returns the palette colors in Oklab, as newGamutMapper sees
+// them.
+func oklabPoints(pal color.Palette) [][3]float64 {
+	var points [][3]float64
+	for _, c := range pal {
+		r, g, b, _ := c.RGBA()
+		points = append(points, srgbToOklab(float64(r>>8), float64(g>>8), float64(b>>8)))
+	}
+	return points
+}
+
+func TestHullProjectionNearest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, name := range []string{"acep7", "bwry", "bwr", "bw"} {
+		pal, err := lookupPalette(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points := oklabPoints(pal.colors())
+		subsets := affineSubsets(len(points))
+		for i := 0; i < 500; i++ {
+			x := srgbToOklab(float64(rng.Intn(256)), float64(rng.Intn(256)), float64(rng.Intn(256)))
+			p := hullProjection(points, subsets, x)
+			if !onHull(points, x, p) {
+				t.Fatalf("%s: %v projected to %v, not the nearest point of the hull", name, x, p)
+			}
+			// points of the hull are their own projection
+			if q := hullProjection(points, subsets, p); squaredDistance(p, q) > 1e-18 {
+				t.Fatalf("%s: %v on the hull moved to %v", name, p, q)
+			}
+		}
+	}
+}
+
+func TestGamutMapper(t *testing.T) {
+	pal, err := lookupPalette("acep7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := oklabPoints(pal.colors())
+	subsets := affineSubsets(len(points))
+
+	full, err := newGamutMapper(pal.colors(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half, err := newGamutMapper(pal.colors(), 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := newGamutMapper(pal.colors(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step := 255.0 / (gamutSteps - 1)
+	inside, outside := 0, 0
+	i := 0
+	for r := 0; r < gamutSteps; r++ {
+		for g := 0; g < gamutSteps; g++ {
+			for b := 0; b < gamutSteps; b++ {
+				node := [3]float64{math.Round(float64(r) * step), math.Round(float64(g) * step), math.Round(float64(b) * step)}
+				x := srgbToOklab(float64(r)*step, float64(g)*step, float64(b)*step)
+				p := hullProjection(points, subsets, x)
+				lab := func(lut []uint8) [3]float64 {
+					return srgbToOklab(float64(lut[i]), float64(lut[i+1]), float64(lut[i+2]))
+				}
+				for c := 0; c < 3; c++ {
+					if d := math.Abs(float64(none.lut[i+c]) - node[c]); d > 1 {
+						t.Fatalf("strength 0 moved %v to %v", node, none.lut[i:i+3])
+					}
+				}
+				if squaredDistance(p, x) < 1e-18 {
+					// in-gamut colors stay put
+					inside++
+					for c := 0; c < 3; c++ {
+						if d := math.Abs(float64(full.lut[i+c]) - node[c]); d > 1 {
+							t.Fatalf("in-gamut %v moved to %v", node, full.lut[i:i+3])
+						}
+					}
+				} else {
+					// out-of-gamut colors land on the hull, up to rounding to
+					// 8 bit sRGB
+					outside++
+					if d := math.Sqrt(squaredDistance(lab(full.lut), p)); d > 0.01 {
+						t.Fatalf("%v mapped %.4f away from its nearest hull point", node, d)
+					}
+					mid := [3]float64{(x[0] + p[0]) / 2, (x[1] + p[1]) / 2, (x[2] + p[2]) / 2}
+					if d := math.Sqrt(squaredDistance(lab(half.lut), mid)); d > 0.01 {
+						t.Fatalf("%v at strength 0.5 mapped %.4f away from halfway to the hull", node, d)
+					}
+				}
+				i += 3
+			}
+		}
+	}
+	if inside == 0 || outside == 0 {
+		t.Fatalf("%d nodes inside and %d outside the hull", inside, outside)
+	}
+
+	for _, s := range []float64{-0.1, 1.5, math.NaN()} {
+		if _, err := newGamutMapper(pal.colors(), s); err == nil {
+			t.Errorf("accepted strength %g", s)
+		}
+	}
+}
+
+func TestGamutMapperApply(t *testing.T) {
+	pal, err := lookupPalette("acep7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gm, err := newGamutMapper(pal.colors(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// grays lie between black and white, and pure red, green and blue are
+	// in the palette
+	img := image.NewRGBA(image.Rect(0, 0, 256+3, 1))
+	for x := 0; x < 256; x++ {
+		img.SetRGBA(x, 0, color.RGBA{uint8(x), uint8(x), uint8(x), 0xff})
+	}
+	img.SetRGBA(256, 0, color.RGBA{255, 0, 0, 0xff})
+	img.SetRGBA(257, 0, color.RGBA{0, 255, 0, 0xff})
+	img.SetRGBA(258, 0, color.RGBA{0, 0, 255, 0xff})
+	got := gm.apply(img).(*image.RGBA)
+	for x := 0; x < img.Bounds().Dx(); x++ {
+		want, c := img.RGBAAt(x, 0), got.RGBAAt(x, 0)
+		for _, d := range []int{int(c.R) - int(want.R), int(c.G) - int(want.G), int(c.B) - int(want.B)} {
+			if d < -1 || d > 1 {
+				t.Errorf("in-gamut %v mapped to %v", want, c)
+				break
+			}
+		}
+	}
+
+	// a saturated cyan is far outside, it ends up on the hull
+	cyan := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	cyan.SetRGBA(0, 0, color.RGBA{0, 255, 255, 0xff})
+	c := gm.apply(cyan).(*image.RGBA).RGBAAt(0, 0)
+	points := oklabPoints(pal.colors())
+	x := srgbToOklab(0, 255, 255)
+	p := hullProjection(points, affineSubsets(len(points)), x)
+	if d := math.Sqrt(squaredDistance(srgbToOklab(float64(c.R), float64(c.G), float64(c.B)), p)); d > 0.01 {
+		t.Errorf("cyan mapped to %v, %.4f away from its nearest hull point", c, d)
+	}
+}
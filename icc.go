@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// iccProfile is an RGB matrix/TRC ICC profile: per channel tone curves to
+// linear light, and the colorants mapping that to the D50 profile
+// connection space.
+type iccProfile struct {
+	curves [3]func(float64) float64
+	// trc holds the tone curves sampled at the 8 bit input levels
+	trc [3][256]float64
+	// toXYZ has the red, green and blue colorants as columns
+	toXYZ [3][3]float64
+}
+
+// xyzToLinearSRGB converts D50 XYZ to linear sRGB (Bradford adapted).
+var xyzToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// srgbToXYZD50 is the inverse of xyzToLinearSRGB, the colorants of sRGB.
+var srgbToXYZD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseICC reads the matrix/TRC part of an RGB display profile. LUT based
+// profiles are not supported.
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if string(data[16:20]) != "RGB " {
+		return nil, errors.Errorf("ICC profile for %q data, only RGB is supported", data[16:20])
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		e := 132 + i*12
+		if e+12 > len(data) {
+			return nil, errors.New("ICC tag table truncated")
+		}
+		offset := binary.BigEndian.Uint32(data[e+4:])
+		size := binary.BigEndian.Uint32(data[e+8:])
+		if uint64(offset)+uint64(size) > uint64(len(data)) {
+			return nil, errors.New("ICC tag out of range")
+		}
+		tags[string(data[e:e+4])] = data[offset : offset+size]
+	}
+
+	p := &iccProfile{}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := tags[name+"XYZ"]
+		if !ok || len(xyz) < 20 || string(xyz[:4]) != "XYZ " {
+			return nil, errors.Errorf("ICC profile has no %sXYZ colorant, only matrix/TRC profiles are supported", name)
+		}
+		for i := 0; i < 3; i++ {
+			p.toXYZ[i][c] = s15Fixed16(xyz[8+i*4:])
+		}
+
+		trc, ok := tags[name+"TRC"]
+		if !ok {
+			return nil, errors.Errorf("ICC profile has no %sTRC curve", name)
+		}
+		curve, err := parseCurve(trc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%sTRC", name)
+		}
+		p.curves[c] = clampCurve(curve)
+		for i := range p.trc[c] {
+			p.trc[c][i] = p.curves[c](float64(i) / 255)
+		}
+	}
+	return p, nil
+}
+
+// parseCurve reads a curv or para tone curve.
+func parseCurve(b []byte) (func(float64) float64, error) {
+	if len(b) < 12 {
+		return nil, errors.New("curve truncated")
+	}
+	switch string(b[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(b[8:]))
+		if len(b) < 12+2*n {
+			return nil, errors.New("curve truncated")
+		}
+		switch n {
+		case 0:
+			return func(x float64) float64 { return x }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(b[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(b[12+2*i:])) / 65535
+		}
+		return func(x float64) float64 {
+			f := x * float64(n-1)
+			i := min(n-2, int(f))
+			return table[i] + (table[i+1]-table[i])*(f-float64(i))
+		}, nil
+
+	case "para":
+		kind := binary.BigEndian.Uint16(b[8:])
+		counts := []int{1, 3, 4, 5, 7}
+		if int(kind) >= len(counts) || len(b) < 12+4*counts[kind] {
+			return nil, errors.Errorf("unsupported parametric curve type %d", kind)
+		}
+		var v [7]float64
+		for i := 0; i < counts[kind]; i++ {
+			v[i] = s15Fixed16(b[12+4*i:])
+		}
+		g, a, bb, c, d, e, f := v[0], v[1], v[2], v[3], v[4], v[5], v[6]
+		return func(x float64) float64 {
+			switch kind {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -bb/a {
+					return math.Pow(a*x+bb, g)
+				}
+				return 0
+			case 2:
+				if x >= -bb/a {
+					return math.Pow(a*x+bb, g) + c
+				}
+				return c
+			case 3:
+				if x >= d {
+					return math.Pow(a*x+bb, g)
+				}
+				return c * x
+			default:
+				if x >= d {
+					return math.Pow(a*x+bb, g) + e
+				}
+				return c*x + f
+			}
+		}, nil
+	}
+	return nil, errors.Errorf("unsupported curve type %q", b[:4])
+}
+
+// clampCurve keeps curve within [0, 1], which also turns the NaN of a
+// degenerate parametric curve, such as a power of a negative base, into 0.
+func clampCurve(curve func(float64) float64) func(float64) float64 {
+	return func(x float64) float64 {
+		v := curve(x)
+		if !(v > 0) {
+			return 0
+		}
+		return math.Min(v, 1)
+	}
+}
+
+// isSRGB reports whether converting with p would leave 8 bit sRGB data
+// unchanged.
+func (p *iccProfile) isSRGB() bool {
+	for i := range p.toXYZ {
+		for j := range p.toXYZ[i] {
+			if math.Abs(p.toXYZ[i][j]-srgbToXYZD50[i][j]) > 0.002 {
+				return false
+			}
+		}
+	}
+	for c := range p.trc {
+		for i, v := range p.trc[c] {
+			if math.Abs(v-srgbToLinear[i]) > 0.001 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// toSRGB converts img from the profile's space into sRGB, the working space
+// of palette matching. Colors outside sRGB are clipped. 16 bit images stay
+// 16 bit. The curves apply to straight colors, so transparent pixels are
+// converted unpremultiplied.
+func (p *iccProfile) toSRGB(img image.Image) image.Image {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToLinearSRGB[i][k] * p.toXYZ[k][j]
+			}
+		}
+	}
+
+	bounds := img.Bounds()
+	if deep(img) {
+		return p.toSRGB16(img, &m)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	pix := dst.Pix
+	opaque := true
+	for i := 0; i < len(pix); i += 4 {
+		r, g, b := p.trc[0][pix[i]], p.trc[1][pix[i+1]], p.trc[2][pix[i+2]]
+		pix[i] = linearToSRGB(m[0][0]*r + m[0][1]*g + m[0][2]*b)
+		pix[i+1] = linearToSRGB(m[1][0]*r + m[1][1]*g + m[1][2]*b)
+		pix[i+2] = linearToSRGB(m[2][0]*r + m[2][1]*g + m[2][2]*b)
+		opaque = opaque && pix[i+3] == 0xff
+	}
+	if opaque {
+		// both layouts agree without transparency, RGBA has the fast paths
+		return &image.RGBA{Pix: dst.Pix, Stride: dst.Stride, Rect: dst.Rect}
+	}
+	return dst
+}
+
+func (p *iccProfile) toSRGB16(img image.Image, m *[3][3]float64) image.Image {
+	var trc [3][]float64
+	for c := range trc {
+		trc[c] = make([]float64, 1<<16)
+		for i := range trc[c] {
+			trc[c][i] = p.curves[c](float64(i) / 0xffff)
+		}
+	}
+
+	bounds := img.Bounds()
+	dst := image.NewNRGBA64(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	pix := dst.Pix
+	opaque := true
+	for i := 0; i < len(pix); i += 8 {
+		r := trc[0][int(pix[i])<<8|int(pix[i+1])]
+		g := trc[1][int(pix[i+2])<<8|int(pix[i+3])]
+		b := trc[2][int(pix[i+4])<<8|int(pix[i+5])]
+		a0, a1 := pix[i+6], pix[i+7]
+		putSRGB16(pix[i:],
+			m[0][0]*r+m[0][1]*g+m[0][2]*b,
+			m[1][0]*r+m[1][1]*g+m[1][2]*b,
+			m[2][0]*r+m[2][1]*g+m[2][2]*b)
+		pix[i+6], pix[i+7] = a0, a1
+		opaque = opaque && a0 == 0xff && a1 == 0xff
+	}
+	if opaque {
+		return &image.RGBA64{Pix: dst.Pix, Stride: dst.Stride, Rect: dst.Rect}
+	}
+	return dst
+}
+
+// readPNGICC returns the profile of a PNG's iCCP chunk, or nil if it has
+// none.
+func readPNGICC(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	var sig [8]byte
+	if _, err := io.ReadFull(br, sig[:]); err != nil {
+		return nil, err
+	}
+	if string(sig[:]) != "\x89PNG\r\n\x1a\n" {
+		return nil, errors.New("not a PNG stream")
+	}
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(head[:4])
+		kind := string(head[4:])
+		// the profile must come before the image data
+		if kind == "IDAT" || kind == "IEND" {
+			return nil, nil
+		}
+		if kind != "iCCP" {
+			if _, err := br.Discard(int(n) + 4); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		chunk := make([]byte, n+4)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		// profile name, NUL, compression method 0, zlib stream
+		name := bytes.IndexByte(chunk, 0)
+		if name < 0 || name+2 > int(n) {
+			return nil, errors.New("bad iCCP chunk")
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(chunk[name+2 : n]))
+		if err != nil {
+			return nil, errors.Wrap(err, "iCCP")
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+}
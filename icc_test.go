@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+)
+
+// iccTag is a tag of a test profile.
+type iccTag struct {
+	sig  string
+	data []byte
+}
+
+// buildICC lays out an RGB display profile with tags, padding each to four
+// bytes.
+func buildICC(tags ...iccTag) []byte {
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, tag := range tags {
+		table = append(table, tag.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(data)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+		for len(data)%4 != 0 {
+			data = append(data, 0)
+		}
+	}
+	profile := append(append(header, table...), data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+func s15Fixed16Bytes(b []byte, v float64) []byte {
+	return binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+}
+
+func xyzTag(x, y, z float64) []byte {
+	b := []byte("XYZ \x00\x00\x00\x00")
+	for _, v := range []float64{x, y, z} {
+		b = s15Fixed16Bytes(b, v)
+	}
+	return b
+}
+
+func curvTag(entries ...uint16) []byte {
+	b := binary.BigEndian.AppendUint32([]byte("curv\x00\x00\x00\x00"), uint32(len(entries)))
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e)
+	}
+	return b
+}
+
+func paraTag(kind uint16, params ...float64) []byte {
+	b := binary.BigEndian.AppendUint16([]byte("para\x00\x00\x00\x00"), kind)
+	b = append(b, 0, 0)
+	for _, v := range params {
+		b = s15Fixed16Bytes(b, v)
+	}
+	return b
+}
+
+// srgbPara is the sRGB tone curve as a type 3 parametric curve.
+var srgbPara = paraTag(3, 2.4, 1/1.055, 0.055/1.055, 1/12.92, 0.04045)
+
+// matrixProfile builds a profile with colorants as columns and one curve for
+// all channels.
+func matrixProfile(colorants [3][3]float64, curve []byte) []byte {
+	var tags []iccTag
+	for c, name := range []string{"r", "g", "b"} {
+		tags = append(tags, iccTag{name + "XYZ", xyzTag(colorants[0][c], colorants[1][c], colorants[2][c])})
+	}
+	for _, name := range []string{"r", "g", "b"} {
+		tags = append(tags, iccTag{name + "TRC", curve})
+	}
+	return buildICC(tags...)
+}
+
+// displayP3 has the Display P3 colorants, adapted to D50.
+var displayP3 = [3][3]float64{
+	{0.5151, 0.2920, 0.1571},
+	{0.2412, 0.6922, 0.0666},
+	{-0.0011, 0.0419, 0.7841},
+}
+
+func TestParseCurve(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		curve []byte
+		want  func(float64) float64
+	}{
+		{"curv identity", curvTag(), func(x float64) float64 { return x }},
+		{"curv gamma", curvTag(563), func(x float64) float64 { return math.Pow(x, 563.0/256) }},
+		{"curv table", curvTag(0, 16384, 65535), func(x float64) float64 {
+			if x < 0.5 {
+				return x * 2 * 16384 / 65535
+			}
+			return (16384 + (x-0.5)*2*(65535-16384)) / 65535
+		}},
+		{"para gamma", paraTag(0, 2.4), func(x float64) float64 { return math.Pow(x, 2.4) }},
+		{"para offset", paraTag(1, 2, 1, -0.2), func(x float64) float64 {
+			if x < 0.2 {
+				return 0
+			}
+			return (x - 0.2) * (x - 0.2)
+		}},
+		{"para offset and floor", paraTag(2, 2, 1, -0.2, 0.1), func(x float64) float64 {
+			if x < 0.2 {
+				return 0.1
+			}
+			return (x-0.2)*(x-0.2) + 0.1
+		}},
+		{"para sRGB", srgbPara, func(x float64) float64 { return linearFromSRGB(x * 255) }},
+		{"para linear segment offsets", paraTag(4, 2, 0.5, 0.5, 0.25, 0.5, 0.01, 0.02), func(x float64) float64 {
+			if x < 0.5 {
+				return 0.25*x + 0.02
+			}
+			return (0.5*x+0.5)*(0.5*x+0.5) + 0.01
+		}},
+	} {
+		curve, err := parseCurve(tc.curve)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		for _, x := range []float64{0, 0.01, 0.1, 0.25, 0.5, 0.75, 1} {
+			// s15Fixed16 parameters are rounded to 1/65536
+			if got, want := curve(x), tc.want(x); math.Abs(got-want) > 1e-4 {
+				t.Errorf("%s(%g) = %g, want %g", tc.name, x, got, want)
+			}
+		}
+	}
+}
+
+func TestParseCurveErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		curve []byte
+	}{
+		{"empty", nil},
+		{"short header", []byte("curv\x00\x00\x00\x00")},
+		{"curv table truncated", curvTag(0, 65535)[:15]},
+		{"para type unknown", paraTag(5, 1, 1, 1, 1, 1, 1, 1, 1)},
+		{"para parameters truncated", paraTag(3, 2.4, 1, 0)},
+		{"other type", append([]byte("sf32\x00\x00\x00\x00"), make([]byte, 8)...)},
+	} {
+		if _, err := parseCurve(tc.curve); err == nil {
+			t.Errorf("%s: parsed, want an error", tc.name)
+		}
+	}
+}
+
+func TestParseICCErrors(t *testing.T) {
+	srgb := matrixProfile(srgbToXYZD50, srgbPara)
+	gray := append([]byte(nil), srgb...)
+	copy(gray[16:], "GRAY")
+	truncated := append([]byte(nil), srgb[:132+12]...)
+	binary.BigEndian.PutUint32(truncated[128:], 6)
+	outOfRange := append([]byte(nil), srgb...)
+	binary.BigEndian.PutUint32(outOfRange[132+8:], 1<<20)
+
+	for _, tc := range []struct {
+		name    string
+		profile []byte
+	}{
+		{"empty", nil},
+		{"short", srgb[:131]},
+		{"no signature", append(make([]byte, 36), srgb[36:]...)},
+		{"gray", gray},
+		{"tag table truncated", truncated},
+		{"tag out of range", outOfRange},
+		{"no colorant", buildICC(iccTag{"rXYZ", xyzTag(1, 0, 0)}, iccTag{"rTRC", srgbPara})},
+		{"short colorant", buildICC(iccTag{"rXYZ", xyzTag(1, 0, 0)[:16]})},
+		{"no curve", buildICC(
+			iccTag{"rXYZ", xyzTag(1, 0, 0)}, iccTag{"gXYZ", xyzTag(0, 1, 0)}, iccTag{"bXYZ", xyzTag(0, 0, 1)},
+			iccTag{"rTRC", srgbPara}, iccTag{"gTRC", srgbPara})},
+		{"bad curve", matrixProfile(srgbToXYZD50, paraTag(7))},
+	} {
+		if _, err := parseICC(tc.profile); err == nil {
+			t.Errorf("%s: parsed, want an error", tc.name)
+		}
+	}
+}
+
+func TestParseICCDegenerateCurve(t *testing.T) {
+	// a negative slope raises a negative base to 2.4, which is NaN
+	p, err := parseICC(matrixProfile(displayP3, paraTag(3, 2.4, -1, 0, 1, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range p.trc[0] {
+		if !(v >= 0 && v <= 1) {
+			t.Fatalf("curve(%d/255) = %g", i, v)
+		}
+	}
+	img := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.NRGBA64{0xc8c8, 0x0101, 0x8080, 0xffff})
+	p.toSRGB(img)
+	p.toSRGB(image.NewRGBA(image.Rect(0, 0, 1, 1)))
+}
+
+func TestParseICCSRGB(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		profile []byte
+		srgb    bool
+	}{
+		{"sRGB", matrixProfile(srgbToXYZD50, srgbPara), true},
+		{"sRGB colorants, gamma 2.2", matrixProfile(srgbToXYZD50, curvTag(563)), false},
+		{"Display P3", matrixProfile(displayP3, srgbPara), false},
+		{"linear", matrixProfile(srgbToXYZD50, curvTag()), false},
+	} {
+		p, err := parseICC(tc.profile)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if p.isSRGB() != tc.srgb {
+			t.Errorf("%s: isSRGB %v, want %v", tc.name, !tc.srgb, tc.srgb)
+		}
+	}
+}
+
+func TestToSRGBUnpremultiplied(t *testing.T) {
+	p, err := parseICC(matrixProfile(displayP3, curvTag(563)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shade := color.NRGBA64{0xc8c8, 0x6464, 0x3232, 0xffff}
+	for _, deepImg := range []bool{false, true} {
+		for _, alpha := range []uint16{0xffff, 0x8080, 0x1010} {
+			var img draw64
+			if deepImg {
+				img = image.NewNRGBA64(image.Rect(0, 0, 2, 1))
+			} else {
+				img = image.NewNRGBA(image.Rect(0, 0, 2, 1))
+			}
+			translucent := shade
+			translucent.A = alpha
+			img.Set(0, 0, shade)
+			img.Set(1, 0, translucent)
+
+			out := p.toSRGB(img)
+			_, isRGBA := out.(*image.RGBA)
+			_, isRGBA64 := out.(*image.RGBA64)
+			if (isRGBA || isRGBA64) != (alpha == 0xffff) {
+				t.Errorf("deep %v alpha %#x: got a %T", deepImg, alpha, out)
+			}
+
+			opaque := color.NRGBA64Model.Convert(out.At(0, 0)).(color.NRGBA64)
+			got := color.NRGBA64Model.Convert(out.At(1, 0)).(color.NRGBA64)
+			if !deepImg {
+				alpha = alpha >> 8 * 0x101
+			}
+			if got.A != alpha {
+				t.Errorf("deep %v: alpha %#x became %#x", deepImg, alpha, got.A)
+			}
+			// the straight color matches the opaque one up to the rounding
+			// of premultiplied At
+			tolerance := 0xffff / int(got.A>>8+1)
+			for c, v := range [3][2]uint16{{got.R, opaque.R}, {got.G, opaque.G}, {got.B, opaque.B}} {
+				if d := int(v[0]) - int(v[1]); d > tolerance || d < -tolerance {
+					t.Errorf("deep %v alpha %#x: channel %d is %#x, opaque %#x", deepImg, alpha, c, v[0], v[1])
+				}
+			}
+		}
+	}
+}
+
+// draw64 is what TestToSRGBUnpremultiplied sets pixels of.
+type draw64 interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}
+
+// pngWithChunk inserts a chunk into an encoded PNG right after IHDR.
+func pngWithChunk(t *testing.T, kind string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(append(chunk, kind...), data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	// signature and the 13 byte IHDR chunk
+	at := 8 + 8 + 13 + 4
+	return append(append(append([]byte(nil), encoded[:at]...), chunk...), encoded[at:]...)
+}
+
+func TestReadPNGICC(t *testing.T) {
+	profile := matrixProfile(displayP3, srgbPara)
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+
+	got, err := readPNGICC(bytes.NewReader(pngWithChunk(t, "iCCP", append([]byte("P3\x00\x00"), compressed.Bytes()...))))
+	if err != nil || !bytes.Equal(got, profile) {
+		t.Errorf("got %d bytes, %v, want the %d byte profile", len(got), err, len(profile))
+	}
+	got, err = readPNGICC(bytes.NewReader(pngWithChunk(t, "tEXt", []byte("Comment\x00none"))))
+	if err != nil || got != nil {
+		t.Errorf("without iCCP got %d bytes, %v", len(got), err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		png  []byte
+	}{
+		{"not a PNG", []byte("GIF89a")},
+		{"no name terminator", pngWithChunk(t, "iCCP", []byte("P3"))},
+		{"bad zlib stream", pngWithChunk(t, "iCCP", []byte("P3\x00\x00garbage"))},
+		{"truncated", pngWithChunk(t, "iCCP", append([]byte("P3\x00\x00"), compressed.Bytes()...))[:60]},
+	} {
+		if _, err := readPNGICC(bytes.NewReader(tc.png)); err == nil {
+			t.Errorf("%s: read a profile, want an error", tc.name)
+		}
+	}
+}
+
+func FuzzParseICC(f *testing.F) {
+	f.Add(matrixProfile(srgbToXYZD50, srgbPara))
+	f.Add(matrixProfile(displayP3, curvTag(0, 100, 5000, 65535)))
+	f.Add(matrixProfile(displayP3, paraTag(4, 2, 0.5, 0.5, 0.25, 0.5, 0.01, 0.02)))
+	f.Add(matrixProfile(displayP3, paraTag(3, 2.4, -1, 0, 1, 0)))
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.NRGBA{200, 100, 50, 255})
+	img.Set(1, 0, color.NRGBA{0, 255, 10, 128})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, err := parseICC(data)
+		if err != nil {
+			return
+		}
+		p.isSRGB()
+		if out := p.toSRGB(img); out.Bounds() != img.Bounds() {
+			t.Fatalf("converted to %v", out.Bounds())
+		}
+	})
+}
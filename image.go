@@ -3,60 +3,20 @@ package main
 import (
 	"fmt"
 	"image"
-	"image/color"
-	"image/draw"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
+	"io"
 	"os"
 	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
-const (
-	WIDTH      = 800
-	WIDTH_HALF = 400
-	HEIGHT     = 480
-)
-
-var palette = []color.Color{
-	color.RGBA{0, 0, 0, 255},       // Black
-	color.RGBA{255, 255, 255, 255}, // White
-	color.RGBA{0, 255, 0, 255},     // Green
-	color.RGBA{0, 0, 255, 255},     // Blue
-	color.RGBA{255, 0, 0, 255},     // Red
-	color.RGBA{255, 255, 0, 255},   // Yellow
-	color.RGBA{255, 128, 0, 255},   // Orange
-}
-
-func closestColor(c color.Color) color.Color {
-	r1, g1, b1, _ := c.RGBA()
-	r1 >>= 8
-	g1 >>= 8
-	b1 >>= 8
-	minDist := uint32(1<<32 - 1)
-	var closest color.Color
-	for _, pc := range palette {
-		r2, g2, b2, _ := pc.RGBA()
-		r2 >>= 8
-		g2 >>= 8
-		b2 >>= 8
-		// Euclidean distance (no sqrt)
-		dr := int32(r1 - r2)
-		dg := int32(g1 - g2)
-		db := int32(b1 - b2)
-		dist := uint32(dr*dr + dg*dg + db*db)
-		if dist < minDist {
-			minDist = dist
-			closest = pc
-		}
-	}
-	return closest
-}
-
 func clamp(v int) uint8 {
 	if v < 0 {
 		return 0
@@ -67,117 +27,8 @@ func clamp(v int) uint8 {
 	return uint8(v)
 }
 
-func mapColorByRGB(r, g, b uint32) (color byte) {
-	if r == 0 && g == 0 && b == 0 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  0;//Black
-		color = 0
-	} else if r == 255 && g == 255 && b == 255 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  1;//White
-		color = 1
-	} else if r == 0 && g == 255 && b == 0 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  2;//Green
-		color = 2
-	} else if r == 0 && g == 0 && b == 255 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  3;//Blue
-		color = 3
-	} else if r == 255 && g == 0 && b == 0 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  4;//Red
-		color = 4
-	} else if r == 255 && g == 255 && b == 0 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  5;//Yellow
-		color = 5
-	} else if r == 255 && g == 128 && b == 0 {
-		// Image[x+(y* bmpInfoHeader.biWidth )] =  6;//Orange
-		color = 6
-	}
-	return
-}
-
-/*
-func mapColorByIndex(color byte) (r, g, b uint8) {
-	switch color {
-	case 0: //Black
-		return 0, 0, 0
-	case 1: // White
-		return 255, 255, 255
-	case 2: // Green
-		return 0, 255, 0
-	case 3: // Blue
-		return 255, 0, 0
-	case 4: // Red
-		return 0, 0, 255
-	case 5: // Yellow
-		return 0, 255, 255
-	case 6: // Orange
-		return 0, 128, 255
-	default: // Black
-		return 0, 0, 0
-	}
-}
-*/
-
-func floydSteinbergDither(img image.Image) (*image.Paletted, []byte) {
-	bounds := img.Bounds()
-	width, height := bounds.Dx(), bounds.Dy()
-	rgba := image.NewNRGBA(bounds)
-	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
-
-	rawData := make([]byte, width*height/2)
-	dithered := image.NewPaletted(bounds, palette)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			i := y*rgba.Stride + x*4
-			oldR := int(rgba.Pix[i])
-			oldG := int(rgba.Pix[i+1])
-			oldB := int(rgba.Pix[i+2])
-			oldColor := color.RGBA{uint8(oldR), uint8(oldG), uint8(oldB), 255}
-			newColor := closestColor(oldColor)
-			nr, ng, nb, _ := newColor.RGBA()
-			nr >>= 8
-			ng >>= 8
-			nb >>= 8
-			rgba.Set(x, y, newColor)
-			dithered.Set(x, y, newColor)
-
-			idx := x/2 + y*WIDTH_HALF
-			c := mapColorByRGB(nr, ng, nb)
-
-			data := rawData[idx]
-			data = data & (^(0xF0 >> ((x % 2) * 4))) //Clear first, then set value
-			rawData[idx] = data | ((c << 4) >> ((x % 2) * 4))
-
-			errR := oldR - int(nr)
-			errG := oldG - int(ng)
-			errB := oldB - int(nb)
-
-			// Diffuse the error
-			for _, offset := range [][3]int{
-				{1, 0, 7},
-				{-1, 1, 3},
-				{0, 1, 5},
-				{1, 1, 1},
-			} {
-				dx, dy, factor := offset[0], offset[1], offset[2]
-				nx, ny := x+dx, y+dy
-				if nx >= 0 && nx < width && ny >= 0 && ny < height {
-					ni := ny*rgba.Stride + nx*4
-					rgba.Pix[ni+0] = clamp(int(rgba.Pix[ni+0]) + errR*factor/16)
-					rgba.Pix[ni+1] = clamp(int(rgba.Pix[ni+1]) + errG*factor/16)
-					rgba.Pix[ni+2] = clamp(int(rgba.Pix[ni+2]) + errB*factor/16)
-				}
-			}
-		}
-	}
-	return dithered, rawData
-}
-
-func resize(src image.Image) image.Image {
-	dstW, dstH := WIDTH, HEIGHT
-	if src.Bounds().Max.Y-src.Bounds().Min.Y > src.Bounds().Max.X-src.Bounds().Min.X {
-		dstW, dstH = HEIGHT, WIDTH
-	}
-	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+func resize(src image.Image, dstW, dstH int) image.Image {
+	dst := newCanvas(src, dstW, dstH)
 	srcBounds := src.Bounds()
 	srcW := srcBounds.Dx()
 	srcH := srcBounds.Dy()
@@ -192,7 +43,7 @@ func resize(src image.Image) image.Image {
 	return dst
 }
 
-func saveDataFile(data []byte) error {
+func saveDataFile(data []byte, panel *panelProfile, pal *paletteProfile) error {
 	genFolder := "gen"
 	err := os.MkdirAll(genFolder, 0744)
 	if err != nil {
@@ -205,11 +56,11 @@ func saveDataFile(data []byte) error {
 	}
 	defer f.Close()
 
-	_, err = f.Write([]byte(
+	_, err = fmt.Fprintf(f,
 		`#include "ImageData.h"
-// 7 Color Image Data 800*480 
-const unsigned char Image7color[192000] = {
-`))
+// %d Color Image Data %d*%d 
+const unsigned char Image7color[%d] = {
+`, len(pal.entries), panel.width, panel.height, len(data))
 	if err != nil {
 		return err
 	}
@@ -240,31 +91,143 @@ const unsigned char Image7color[192000] = {
 }
 
 func convertImage(c *cli.Context) error {
+	if c.Bool("recursive") {
+		return convertTree(c)
+	}
 	if len(c.Args()) != 1 {
 		return errors.New("Usage: convert input.jpg")
 	}
+	for _, name := range []string{"jobs", "force"} {
+		if c.IsSet(name) {
+			return fmt.Errorf("--%s needs --recursive", name)
+		}
+	}
+
+	conv, err := newConversion(c)
+	if err != nil {
+		return err
+	}
 
 	inputFilename := c.Args()[0]
-	outputFilename := inputFilename + ".bmp"
-	epaperFilename := inputFilename + ".epa"
+	outputBase := inputFilename
+	if out := c.String("out"); out != "" {
+		if err = os.MkdirAll(out, 0755); err != nil {
+			return err
+		}
+		outputBase = filepath.Join(out, filepath.Base(inputFilename))
+	}
+	epaperResult, err := conv.convertFile(inputFilename, outputBase, os.Stdout)
+	if err != nil {
+		return err
+	}
+	return saveDataFile(epaperResult, conv.panel, conv.pal)
+}
 
+// convertFile converts the image at inputFilename into outputBase.bmp and
+// outputBase.epa, or into numbered files per frame when frames are selected,
+// and reports them on w. It returns the panel data of the first frame.
+func (conv *conversion) convertFile(inputFilename, outputBase string, w io.Writer) ([]byte, error) {
 	inputFile, err := os.Open(inputFilename)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	defer inputFile.Close()
 
-	srcImg, _, err := image.Decode(inputFile)
+	srcImg, format, err := image.Decode(inputFile)
+	if err == image.ErrFormat {
+		return nil, unsupportedFormat(inputFile, inputFilename)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode %s", inputFilename)
+	}
+
+	var (
+		exif *exifInfo
+		icc  []byte
+	)
+	// metadata is optional, a broken one only loses what it would correct
+	switch {
+	case format == "jpeg" && !(conv.ignoreEXIF && conv.ignoreICC):
+		if _, err = inputFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		meta, err := readJPEGMetadata(inputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring metadata of %s: %v\n", inputFilename, err)
+			break
+		}
+		if !conv.ignoreEXIF {
+			if meta.exifErr != nil {
+				fmt.Fprintf(os.Stderr, "Ignoring EXIF data of %s: %v\n", inputFilename, meta.exifErr)
+			}
+			exif = meta.exif
+		}
+		if !conv.ignoreICC {
+			if meta.iccErr != nil {
+				fmt.Fprintf(os.Stderr, "Ignoring color profile of %s: %v\n", inputFilename, meta.iccErr)
+			}
+			icc = meta.icc
+		}
+	case format == "png" && !conv.ignoreICC:
+		if _, err = inputFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		icc, err = readPNGICC(inputFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring color profile of %s: %v\n", inputFilename, err)
+			icc = nil
+		}
+	}
+
+	if icc != nil {
+		profile, err := parseICC(icc)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring color profile of %s: %v\n", inputFilename, err)
+		} else if !profile.isSRGB() {
+			srcImg = profile.toSRGB(srcImg)
+		}
+	}
+	if exif != nil {
+		srcImg = applyOrientation(srcImg, exif.orientation)
+	}
+
+	if conv.frames != nil {
+		if _, err = inputFile.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		seq, err := readFrames(inputFile, format, srcImg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read frames of %s", inputFilename)
+		}
+		indices := conv.frames.pick(seq.count)
+		if len(indices) == 0 {
+			return nil, fmt.Errorf("--frames selects none of the %d frames of %s", seq.count, inputFilename)
+		}
+		return conv.convertSequence(seq, indices, outputBase, w)
+	}
+
+	result, epaperResult, err := conv.convert(srcImg)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	outputFilename, epaperFilename := outputBase+".bmp", outputBase+".epa"
+	if err = writeOutputs(outputFilename, epaperFilename, result, epaperResult); err != nil {
+		return nil, err
 	}
 
-	resized := resize(srcImg)
-	result, epaperResult := floydSteinbergDither(resized)
+	fmt.Fprintf(w, "Dithering complete. Output saved to %s and %s\n",
+		outputFilename, epaperFilename)
+	if exif != nil && !exif.captured.IsZero() {
+		fmt.Fprintln(w, "Captured", exif.captured.Format("2006-01-02 15:04:05"))
+	}
+	return epaperResult, nil
+}
 
+// writeOutputs saves the dithered image as a bmp and the panel data.
+func writeOutputs(outputFilename, epaperFilename string, result *image.Paletted, epaperResult []byte) error {
 	outputFile, err := os.Create(outputFilename)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer outputFile.Close()
 
@@ -273,15 +236,182 @@ func convertImage(c *cli.Context) error {
 		return err
 	}
 
-	err = os.WriteFile(epaperFilename, epaperResult, 0644)
+	return os.WriteFile(epaperFilename, epaperResult, 0644)
+}
+
+// conversion holds the convert img settings shared by every image it
+// converts.
+type conversion struct {
+	dither    ditherer
+	metric    *colorMetric
+	panel     *panelProfile
+	pal       *paletteProfile
+	filter    *resampleFilter
+	fit       *fitOptions
+	diffusion diffusionOptions
+	adj       *adjustments
+	gamut     *gamutMapper
+
+	ignoreEXIF bool
+	ignoreICC  bool
+	// frames is nil unless --frames is given
+	frames *frameSelection
+	// crop is empty unless --crop is given
+	crop            image.Rectangle
+	orientation     string
+	rotate          int
+	alphaBackground *alphaBackground
+	clahe           bool
+	claheTile       int
+	claheClip       float64
+}
+
+func newConversion(c *cli.Context) (*conversion, error) {
+	conv := &conversion{
+		ignoreEXIF:  c.Bool("ignore-exif"),
+		ignoreICC:   c.Bool("ignore-icc"),
+		orientation: c.String("orientation"),
+		rotate:      c.Int("rotate"),
+		clahe:       c.Bool("clahe"),
+		claheTile:   c.Int("clahe-tile"),
+		claheClip:   c.Float64("clahe-clip"),
+	}
+
+	var err error
+	if c.String("frames") != "" {
+		conv.frames, err = parseFrames(c.String("frames"), c.Int("frame-step"))
+		if err != nil {
+			return nil, err
+		}
+	} else if c.Int("frame-step") != 1 {
+		return nil, errors.New("--frame-step needs --frames")
+	}
+
+	conv.dither, err = lookupDitherer(c.String("dither"))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	conv.metric, err = lookupMetric(c.String("metric"))
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Dithering complete. Output saved to %s and %s\n",
-		outputFilename, epaperFilename)
+	conv.panel, conv.pal, err = lookupPanelPalette(c.String("panel"), c.String("palette"))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.String("crop") != "" {
+		conv.crop, err = parseCrop(c.String("crop"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conv.filter, err = lookupResample(c.String("resample"))
+	if err != nil {
+		return nil, err
+	}
+
+	conv.alphaBackground, err = newAlphaBackground(c.String("alpha-background"), conv.pal, conv.filter)
+	if err != nil {
+		return nil, err
+	}
+
+	conv.fit = &fitOptions{}
+	conv.fit.mode, err = parseFit(c.String("fit"))
+	if err != nil {
+		return nil, err
+	}
+	conv.fit.background, err = conv.pal.entry(c.String("background"))
+	if err != nil {
+		return nil, err
+	}
+	conv.fit.focusX, conv.fit.focusY, err = parseFocus(c.String("focus"))
+	if err != nil {
+		return nil, err
+	}
+
+	conv.diffusion = diffusionOptions{
+		serpentine: c.Bool("serpentine"),
+		strength:   c.Float64("diffusion-strength"),
+		limit:      c.Float64("error-limit"),
+	}
+	if err = conv.diffusion.validate(); err != nil {
+		return nil, err
+	}
+
+	conv.adj = &adjustments{
+		autoLevels: c.Float64("auto-levels"),
+		brightness: c.Float64("brightness"),
+		contrast:   c.Float64("contrast"),
+		gamma:      c.Float64("gamma"),
+		saturation: c.Float64("saturation"),
+		sharpen:    c.Float64("sharpen"),
+		radius:     c.Float64("sharpen-radius"),
+	}
+	if err = conv.adj.validate(); err != nil {
+		return nil, err
+	}
+
+	if strength := c.Float64("gamut-map"); strength != 0 {
+		conv.gamut, err = newGamutMapper(conv.pal.colors(), strength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return conv, nil
+}
 
-	return saveDataFile(epaperResult)
+// convert dithers srcImg for the panel. It returns the dithered image as it
+// is viewed and the panel data.
+func (conv *conversion) convert(srcImg image.Image) (*image.Paletted, []byte, error) {
+	adjusted, place, err := conv.prepare(srcImg)
+	if err != nil {
+		return nil, nil, err
+	}
+	result := conv.dither(adjusted, &ditherConfig{metric: conv.metric, palette: conv.pal, diffusion: conv.diffusion})
+	return result, conv.panel.encode(rotate(result, place.turns), conv.pal), nil
+}
+
+// prepare crops, fits and corrects srcImg into the image that is dithered,
+// as it is viewed.
+func (conv *conversion) prepare(srcImg image.Image) (image.Image, *placement, error) {
+	var err error
+	if !conv.crop.Empty() {
+		srcImg, err = cropImage(srcImg, conv.crop)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	place, err := placeImage(conv.panel, conv.orientation, conv.rotate, srcImg.Bounds())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !opaque(srcImg) {
+		bounds := srcImg.Bounds()
+		srcImg = composite(srcImg, conv.alphaBackground.at(bounds.Dx(), bounds.Dy()))
+	}
+
+	resized, err := fitImage(srcImg, place.width, place.height, conv.filter, conv.fit)
+	if err != nil {
+		return nil, nil, err
+	}
+	adjusted := adjust(resized, conv.adj)
+	if conv.clahe {
+		adjusted, err = clahe(adjusted, conv.claheTile, conv.claheClip)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// the bars keep the background color and stay out of the histograms
+	adjusted = letterbox(adjusted, place.width, place.height, conv.fit)
+	if conv.gamut != nil {
+		adjusted = conv.gamut.apply(adjusted)
+	}
+	return adjusted, place, nil
 }
 
 func convertRaw(c *cli.Context) error {
@@ -302,23 +432,21 @@ func convertRaw(c *cli.Context) error {
 		}
 	}
 
-	width, height := WIDTH, HEIGHT
-	bounds := image.Rect(0, 0, width, height)
-	img := image.NewPaletted(bounds, palette)
-
-	pixelIndex := 0
+	panel, pal, err := lookupPanelPalette(c.String("panel"), c.String("palette"))
+	if err != nil {
+		return err
+	}
 
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x += 2 {
-			byteVal := data[pixelIndex]
-			hi := (byteVal & 0xF0) >> 4
-			lo := byteVal & 0x0F
+	place, err := placeImage(panel, c.String("orientation"), c.Int("rotate"), image.Rectangle{})
+	if err != nil {
+		return err
+	}
 
-			img.Set(x, y, palette[hi%8])
-			img.Set(x+1, y, palette[lo%8])
-			pixelIndex++
-		}
+	img, err := panel.decode(data, pal)
+	if err != nil {
+		return err
 	}
+	img = rotate(img, -place.turns)
 
 	outputFile, err := os.Create(outputFilename)
 	if err != nil {
@@ -333,3 +461,40 @@ func convertRaw(c *cli.Context) error {
 	println("Convertion complete. Output saved to", outputFilename)
 	return nil
 }
+
+// knownFormats names image formats by their leading bytes, so inputs that
+// image.Decode has no decoder for get a useful error.
+var knownFormats = []struct {
+	name   string
+	offset int
+	magic  string
+}{
+	{"HEIC", 4, "ftypheic"},
+	{"HEIC", 4, "ftypheix"},
+	{"HEIC", 4, "ftypmif1"},
+	{"AVIF", 4, "ftypavif"},
+	{"JPEG XL", 0, "\xff\x0a"},
+	{"JPEG XL", 0, "\x00\x00\x00\x0cJXL "},
+	{"JPEG 2000", 0, "\x00\x00\x00\x0cjP  "},
+	{"Photoshop", 0, "8BPS"},
+	{"ICO", 0, "\x00\x00\x01\x00"},
+	{"SVG", 0, "<svg"},
+	{"SVG", 0, "<?xml"},
+}
+
+func unsupportedFormat(f *os.File, filename string) error {
+	const supported = "bmp, gif, jpeg, png, tiff, webp"
+	head := make([]byte, 16)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	for _, k := range knownFormats {
+		if len(head) >= k.offset+len(k.magic) && string(head[k.offset:k.offset+len(k.magic)]) == k.magic {
+			return errors.Errorf("%s is a %s image, which is not supported (supported: %s)",
+				filename, k.name, supported)
+		}
+	}
+	return errors.Errorf("%s is not in a supported image format (supported: %s)", filename, supported)
+}
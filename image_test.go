@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// imgContext parses args with the flags of convert img, without running it.
+func imgContext(t *testing.T, args ...string) *cli.Context {
+	t.Helper()
+	for _, cmd := range newApp().Command("convert").Subcommands {
+		if cmd.Name != "img" {
+			continue
+		}
+		set := flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+		for _, f := range cmd.Flags {
+			f.Apply(set)
+		}
+		if err := set.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return cli.NewContext(nil, set, nil)
+	}
+	t.Fatal("no convert img command")
+	return nil
+}
+
+// captureStdout runs fn and returns what it printed.
+func captureStdout(t *testing.T, fn func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+
+	err = fn()
+	w.Close()
+	return <-output, err
+}
+
+func testConversion(t *testing.T, args ...string) *conversion {
+	t.Helper()
+	conv, err := newConversion(imgContext(t, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conv
+}
+
+func TestConvertFileMalformedExif(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 16, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// an APP1 segment with a broken byte order right after the SOI marker
+	data := append([]byte{0xFF, 0xD8}, exifSegment([]byte("XX*\x00\x08\x00\x00\x00"))...)
+	data = append(data, buf.Bytes()[2:]...)
+
+	input := filepath.Join(t.TempDir(), "broken.jpg")
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testConversion(t).convertFile(input, input, io.Discard); err != nil {
+		t.Fatalf("malformed EXIF failed the conversion: %v", err)
+	}
+	if _, err := os.Stat(input + ".epa"); err != nil {
+		t.Error(err)
+	}
+}
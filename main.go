@@ -2,12 +2,14 @@ package main
 
 import (
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/leslie-wang/blecli/codec"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"tinygo.org/x/bluetooth"
 )
@@ -18,6 +20,13 @@ var writeUUID = baseUUID(0x6e40)
 var notifyUUID = baseUUID(0x6e41)
 var advName = "pico2w_ble"
 
+// writeDelay gives the peripheral time to process a request, and
+// responseWait gives it time to notify the response before disconnecting.
+var (
+	writeDelay   = 3 * time.Second
+	responseWait = time.Second
+)
+
 func baseUUID(short uint16) bluetooth.UUID {
 	var b = [16]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0x80, 0x5F, 0x9B, 0x34, 0xFB}
 	b[2] = byte(short >> 8)
@@ -25,37 +34,25 @@ func baseUUID(short uint16) bluetooth.UUID {
 	return bluetooth.NewUUID(b)
 }
 
-type methodType byte
-
-const (
-	echo methodType = iota
-	uploadImage
-	deleteImage
-	listImages
-	getImage
-)
-
-func (m methodType) String() string {
-	switch m {
-	case echo:
-		return "echo"
-	case uploadImage:
-		return "upload"
-	case deleteImage:
-		return "delete"
-	case listImages:
-		return "list"
-	case getImage:
-		return "get"
-	default:
-		return "unknown"
-	}
-}
-
-func main() {
-	app := &cli.App{
+func newApp() *cli.App {
+	return &cli.App{
 		Name:  "bleclient",
 		Usage: "BLE Client for file operations",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "psk",
+				Usage:  "hex encoded pre-shared key of the device, enables payload encryption",
+				EnvVar: "BLECLI_PSK",
+			},
+			cli.StringFlag{
+				Name:  "replay",
+				Usage: "answer writes from this trace file instead of connecting to a device",
+			},
+			cli.StringFlag{
+				Name:  "trace",
+				Usage: "record every frame written and notified to this JSON lines file",
+			},
+		},
 		Commands: []cli.Command{
 			{
 				Name:   "scan",
@@ -71,6 +68,28 @@ func main() {
 				Name:   "upload",
 				Usage:  "Upload a file",
 				Action: runUpload,
+				Flags: []cli.Flag{
+					cli.IntFlag{
+						Name:  "chunk-size",
+						Value: 20,
+						Usage: "maximum bytes per write, must fit the negotiated MTU less 3 (and less 24 more with --psk); 0 sends one write",
+					},
+					cli.DurationFlag{
+						Name:  "chunk-delay",
+						Value: 30 * time.Millisecond,
+						Usage: "pause between two chunk writes",
+					},
+					cli.IntFlag{
+						Name:  "retries",
+						Value: 3,
+						Usage: "how often a failed chunk write is retried",
+					},
+					cli.StringFlag{
+						Name:  "progress",
+						Value: progressAuto,
+						Usage: "progress output: auto, bar, json or none",
+					},
+				},
 			},
 			{
 				Name:   "delete",
@@ -87,26 +106,223 @@ func main() {
 				Usage:  "Get one file",
 				Action: runGetFile,
 			},
+			{
+				Name:  "trace",
+				Usage: "Inspect captured protocol traces",
+				Subcommands: cli.Commands{
+					{
+						Name:   "show",
+						Usage:  "Decode and print a trace file",
+						Action: runTraceShow,
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "full",
+								Usage: "print whole payloads instead of the first 32 bytes",
+							},
+						},
+					},
+				},
+			},
 			{
 				Name: "convert",
 				Subcommands: cli.Commands{
 					{
 						Name:   "img",
-						Usage:  "Convert one image to album suitable format and raw data",
+						Usage:  "Convert one image, or a tree of them with --recursive, to album suitable format and raw data",
 						Action: convertImage,
+						Flags: []cli.Flag{
+							cli.BoolFlag{
+								Name:  "recursive",
+								Usage: "convert every image under the directory argument",
+							},
+							cli.StringFlag{
+								Name:  "out",
+								Usage: "directory for the outputs, mirroring the input tree with --recursive (default: next to the inputs)",
+							},
+							cli.IntFlag{
+								Name:  "jobs",
+								Usage: "images converted at once with --recursive (default: number of CPUs)",
+							},
+							cli.BoolFlag{
+								Name:  "force",
+								Usage: "with --recursive, also convert inputs whose outputs are newer than them",
+							},
+							cli.StringFlag{
+								Name:  "dither",
+								Value: defaultDither,
+								Usage: "dithering algorithm: " + strings.Join(ditherNames(), ", "),
+							},
+							cli.BoolFlag{
+								Name:  "serpentine",
+								Usage: "scan every other row right to left when diffusing errors",
+							},
+							cli.Float64Flag{
+								Name:  "diffusion-strength",
+								Value: defaultDiffusion.strength,
+								Usage: "share of the quantization error to diffuse, from 0 to 1",
+							},
+							cli.Float64Flag{
+								Name:  "error-limit",
+								Usage: "cap the diffused error per channel, as a fraction of its range (0 for no cap)",
+							},
+							cli.StringFlag{
+								Name:  "metric",
+								Value: defaultMetric,
+								Usage: "color distance: " + strings.Join(metricNames(), ", "),
+							},
+							cli.StringFlag{
+								Name:  "resample",
+								Value: defaultResample,
+								Usage: "resize filter: " + strings.Join(resampleNames(), ", "),
+							},
+							cli.BoolFlag{
+								Name:  "ignore-exif",
+								Usage: "do not turn JPEG photos upright by their EXIF orientation",
+							},
+							cli.BoolFlag{
+								Name:  "ignore-icc",
+								Usage: "treat the input as sRGB even if it embeds a color profile",
+							},
+							cli.StringFlag{
+								Name:  "fit",
+								Value: fitStretch,
+								Usage: "how the image fills the panel: " + strings.Join(fitModes, ", "),
+							},
+							cli.StringFlag{
+								Name:  "background",
+								Value: "white",
+								Usage: "palette color of the bars added by --fit contain",
+							},
+							cli.StringFlag{
+								Name:  "alpha-background",
+								Value: "white",
+								Usage: "palette color or image file shown through transparent parts of the input",
+							},
+							cli.StringFlag{
+								Name:  "focus",
+								Value: "0.5,0.5",
+								Usage: "point kept in view by --fit cover, as x,y fractions of the image",
+							},
+							cli.StringFlag{
+								Name:  "crop",
+								Usage: "crop the input to x,y,w,h pixels first",
+							},
+							cli.Float64Flag{
+								Name:  "auto-levels",
+								Usage: "stretch levels, clipping this percentage of samples at each end",
+							},
+							cli.Float64Flag{
+								Name:  "brightness",
+								Usage: "brightness offset, as a fraction of full scale",
+							},
+							cli.Float64Flag{
+								Name:  "contrast",
+								Value: 1,
+								Usage: "contrast factor around mid gray",
+							},
+							cli.Float64Flag{
+								Name:  "gamma",
+								Value: 1,
+								Usage: "gamma, above 1 brightens midtones",
+							},
+							cli.Float64Flag{
+								Name:  "saturation",
+								Value: 1,
+								Usage: "saturation factor",
+							},
+							cli.Float64Flag{
+								Name:  "sharpen",
+								Usage: "unsharp mask amount",
+							},
+							cli.Float64Flag{
+								Name:  "sharpen-radius",
+								Value: 1,
+								Usage: "unsharp mask radius (Gaussian sigma) in pixels",
+							},
+							cli.BoolFlag{
+								Name:  "clahe",
+								Usage: "equalize lightness locally (CLAHE) to bring out shadow and highlight detail",
+							},
+							cli.IntFlag{
+								Name:  "clahe-tile",
+								Value: 64,
+								Usage: "CLAHE tile size in pixels",
+							},
+							cli.Float64Flag{
+								Name:  "clahe-clip",
+								Value: 2,
+								Usage: "CLAHE clip limit, as a multiple of the average histogram bin",
+							},
+							cli.Float64Flag{
+								Name:  "gamut-map",
+								Usage: "pull colors the palette cannot reproduce towards its gamut, from 0 (off) to 1 (onto it)",
+							},
+							cli.StringFlag{
+								Name:  "frames",
+								Usage: "convert these frames of an animated GIF or pages of a TIFF into numbered files and a playlist: all, or a list like 1-10,15,20-",
+							},
+							cli.IntFlag{
+								Name:  "frame-step",
+								Value: 1,
+								Usage: "keep every n-th of the frames selected by --frames",
+							},
+							cli.StringFlag{
+								Name:  "panel",
+								Value: defaultPanel,
+								Usage: "panel profile: " + strings.Join(panelNames(), ", "),
+							},
+							cli.StringFlag{
+								Name:  "palette",
+								Usage: "palette profile, defaults to the panel's own: " + strings.Join(paletteNames(), ", "),
+							},
+							cli.StringFlag{
+								Name:  "orientation",
+								Value: orientationAuto,
+								Usage: "how the image is viewed: auto, landscape or portrait",
+							},
+							cli.IntFlag{
+								Name:  "rotate",
+								Value: -1,
+								Usage: "clockwise degrees from the viewed image to the panel's scan order: 0, 90, 180 or 270 (default: 90 if the orientation differs from the panel's, else 0)",
+							},
+						},
 					},
 					{
 						Name:   "raw",
 						Usage:  "Convert one raw data to bmp",
 						Action: convertRaw,
+						Flags: []cli.Flag{
+							cli.StringFlag{
+								Name:  "panel",
+								Value: defaultPanel,
+								Usage: "panel profile: " + strings.Join(panelNames(), ", "),
+							},
+							cli.StringFlag{
+								Name:  "palette",
+								Usage: "palette profile, defaults to the panel's own: " + strings.Join(paletteNames(), ", "),
+							},
+							cli.StringFlag{
+								Name:  "orientation",
+								Value: orientationAuto,
+								Usage: "how the image is viewed: auto, landscape or portrait",
+							},
+							cli.IntFlag{
+								Name:  "rotate",
+								Value: -1,
+								Usage: "clockwise degrees from the viewed image to the panel's scan order: 0, 90, 180 or 270 (default: 90 if the orientation differs from the panel's, else 0)",
+							},
+						},
 					},
 				},
 			},
 		},
 	}
+}
 
-	if err := app.Run(os.Args); err != nil {
+func main() {
+	if err := newApp().Run(os.Args); err != nil {
 		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
 	}
 }
 func scan(c *cli.Context) error {
@@ -123,11 +339,62 @@ func scan(c *cli.Context) error {
 	})
 }
 
-func connectToPeripheral() (*bluetooth.Device, *bluetooth.DeviceCharacteristic,
-	*bluetooth.DeviceCharacteristic, error) {
+// connect connects to the peripheral, runs the encryption handshake when a
+// pre-shared key is configured, and records the plain frames when tracing.
+func connect(c *cli.Context) (transport, error) {
+	var psk []byte
+	if s := c.GlobalString("psk"); s != "" {
+		var err error
+		psk, err = parsePSK(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t, err := dial(c)
+	if err != nil {
+		return nil, err
+	}
+	result := t
+	if psk != nil {
+		result, err = newSecureTransport(t, psk)
+		if err != nil {
+			t.Disconnect()
+			return nil, err
+		}
+	}
+
+	if filename := c.GlobalString("trace"); filename != "" {
+		result, err = newTraceTransport(result, filename)
+		if err != nil {
+			t.Disconnect()
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// disconnect closes t when a command is done. Its error, e.g. recorded
+// frames a replay never reached, fails the command unless it failed already.
+func disconnect(t transport, err *error) {
+	if derr := t.Disconnect(); derr != nil && *err == nil {
+		*err = derr
+	}
+}
+
+// dial opens the transport to the peripheral, or to a recorded session when
+// replaying. Tests replace it to drive commands from their own recordings.
+var dial = func(c *cli.Context) (transport, error) {
+	if filename := c.GlobalString("replay"); filename != "" {
+		return openReplay(filename)
+	}
+	return connectToPeripheral()
+}
+
+func connectToPeripheral() (*bleTransport, error) {
 	err := adapter.Enable()
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	var found bool
@@ -142,178 +409,222 @@ func connectToPeripheral() (*bluetooth.Device, *bluetooth.DeviceCharacteristic,
 		adapter.StopScan()
 	})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	if !found {
-		return nil, nil, nil, errors.New("PicoServer not found")
+		return nil, errors.New("PicoServer not found")
 	}
 
 	device, err := adapter.Connect(deviceAddress, bluetooth.ConnectionParams{})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 	services, err := device.DiscoverServices([]bluetooth.UUID{serviceUUID})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	writeChars, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{writeUUID})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	notiChars, err := services[0].DiscoverCharacteristics([]bluetooth.UUID{notifyUUID})
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
-	return &device, &writeChars[0], &notiChars[0], nil
+	return &bleTransport{
+		device:     device,
+		writeChar:  writeChars[0],
+		notifyChar: notiChars[0],
+	}, nil
 }
 
-func writeWithDelay(char *bluetooth.DeviceCharacteristic, data []byte) error {
-	_, err := char.WriteWithoutResponse(data)
-	time.Sleep(3 * time.Second)
+func writeWithDelay(t transport, data []byte) error {
+	err := t.Write(data)
+	time.Sleep(writeDelay)
 	return err
 }
 
-func writeHeader(char *bluetooth.DeviceCharacteristic, m methodType) error {
-	return writeWithDelay(char, []byte{byte(m)})
-}
-
-func sendRequest(char *bluetooth.DeviceCharacteristic, m methodType, body []byte) error {
-	fmt.Printf("Sending method %s and content (%dB)\n", m, len(body))
+func sendRequest(t transport, req codec.Message) error {
+	frame, err := req.Encode()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending method %s and content (%dB)\n", req.Method(), len(frame)-1)
 
-	return writeWithDelay(char, append([]byte{byte(m)}, body...))
+	return writeWithDelay(t, frame)
 }
 
-func runEcho(c *cli.Context) error {
-	device, writeChar, notifyChar, err := connectToPeripheral()
+// sendRequestChunked sends the request split into writes of at most
+// chunkSize bytes, or in one write when chunkSize is 0. A failed write is
+// retried up to retries times.
+func sendRequestChunked(t transport, req codec.Message, chunkSize int,
+	delay time.Duration, retries int, p *progress) error {
+	if chunkSize < 0 {
+		return fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	frame, err := req.Encode()
 	if err != nil {
 		return err
 	}
-	defer device.Disconnect()
+	if chunkSize == 0 {
+		chunkSize = len(frame)
+	}
+	fmt.Printf("Sending method %s and content (%dB) in %dB chunks\n", req.Method(), len(frame)-1, chunkSize)
+
+	p.start = time.Now()
+	for off := 0; off < len(frame); off += chunkSize {
+		chunk := frame[off:min(off+chunkSize, len(frame))]
+		err := t.Write(chunk)
+		for attempt := 0; err != nil && attempt < retries; attempt++ {
+			p.retransmit()
+			time.Sleep(delay + time.Duration(attempt)*100*time.Millisecond)
+			err = t.Write(chunk)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write chunk at offset %d", off)
+		}
+		p.add(len(chunk))
+		time.Sleep(delay)
+	}
+	p.finish()
 
-	// Enable notifications before sending the request
-	notifyChar.EnableNotifications(func(buf []byte) {
-		fmt.Println("Received response:", string(buf))
-	})
+	time.Sleep(writeDelay)
+	return nil
+}
 
-	time.Sleep(time.Second)
+// printResponse returns a notification callback that decodes responses to m
+// and prints them after label.
+func printResponse(label string, m codec.Method) func(buf []byte) {
+	return func(buf []byte) {
+		resp, err := codec.DecodeResponse(m, buf)
+		if err != nil {
+			fmt.Printf("%s %q (%v)\n", label, buf, err)
+			return
+		}
+		// the file itself is the answer to get, its size only suits traces
+		if get, ok := resp.(*codec.GetResponse); ok {
+			fmt.Println(label, string(get.Content))
+			return
+		}
+		fmt.Println(label, resp)
+	}
+}
 
-	err = sendRequest(writeChar, echo, []byte("ping!"))
+func runEcho(c *cli.Context) (err error) {
+	t, err := connect(c)
 	if err != nil {
 		return err
 	}
+	defer disconnect(t, &err)
 
-	return sendRequest(writeChar, echo, []byte("pong!"))
-}
+	// Enable notifications before sending the request
+	t.EnableNotifications(printResponse("Received response:", codec.Echo))
+
+	time.Sleep(responseWait)
 
-func prepareFileHeader(md5hex string, v uint32) ([]byte, error) {
-	buf := make([]byte, 16)
-	_, err := fmt.Sscanf(md5hex, "%x", &buf)
+	err = sendRequest(t, &codec.EchoRequest{Payload: []byte("ping!")})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	fmt.Printf("md5sum: %s\n", md5hex)
-
-	buf = append(buf, byte(v>>24))
-	buf = append(buf, byte(v>>16))
-	buf = append(buf, byte(v>>8))
-	buf = append(buf, byte(v))
-
-	return buf, nil
+	return sendRequest(t, &codec.EchoRequest{Payload: []byte("pong!")})
 }
 
-func runUpload(c *cli.Context) error {
+func runUpload(c *cli.Context) (err error) {
 	filename := c.Args()[0]
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
-	buf, err := prepareFileHeader(fmt.Sprintf("%x", md5.Sum(content)), uint32(len(content)))
+	req := &codec.UploadRequest{
+		MD5:     md5.Sum(content),
+		Size:    uint32(len(content)),
+		Content: content,
+	}
+	fmt.Printf("md5sum: %s\n", req.MD5)
+
+	p, err := newProgress(c.String("progress"), 1+codec.FileHeaderSize+len(content))
 	if err != nil {
 		return err
 	}
 
-	device, writeChar, notifyChar, err := connectToPeripheral()
+	t, err := connect(c)
 	if err != nil {
 		return err
 	}
-	defer device.Disconnect()
+	defer disconnect(t, &err)
 
-	notifyChar.EnableNotifications(func(buf []byte) {
-		fmt.Println("Received upload response:", string(buf))
-	})
+	t.EnableNotifications(printResponse("Received upload response:", codec.Upload))
 
-	return sendRequest(writeChar, uploadImage, append(buf, content...))
+	return sendRequestChunked(t, req, c.Int("chunk-size"),
+		c.Duration("chunk-delay"), c.Int("retries"), p)
 }
 
-func runDelete(c *cli.Context) error {
-	md5hex := c.Args()[0]
-	if len(md5hex) != 32 {
-		return fmt.Errorf("MD5 must be 32 hex characters")
+func runDelete(c *cli.Context) (err error) {
+	if len(c.Args()) != 2 {
+		return errors.New("Usage: delete <md5> <size>")
 	}
-
-	size, err := strconv.Atoi(c.Args()[1])
+	sum, err := codec.ParseMD5(c.Args()[0])
 	if err != nil {
 		return err
 	}
 
-	payload, err := prepareFileHeader(md5hex, uint32(size))
+	size, err := strconv.ParseUint(c.Args()[1], 10, 32)
 	if err != nil {
 		return err
 	}
+	fmt.Printf("md5sum: %s\n", sum)
 
-	device, writeChar, notifyChar, err := connectToPeripheral()
+	t, err := connect(c)
 	if err != nil {
 		return err
 	}
-	defer device.Disconnect()
+	defer disconnect(t, &err)
 
-	notifyChar.EnableNotifications(func(buf []byte) {
-		fmt.Println("Received delete image response:", string(buf))
-	})
+	t.EnableNotifications(printResponse("Received delete image response:", codec.Delete))
 
-	return sendRequest(writeChar, deleteImage, payload)
+	return sendRequest(t, &codec.DeleteRequest{MD5: sum, Size: uint32(size)})
 }
 
-func runList(c *cli.Context) error {
-	device, writeChar, notifyChar, err := connectToPeripheral()
+func runList(c *cli.Context) (err error) {
+	t, err := connect(c)
 	if err != nil {
 		return err
 	}
-	defer device.Disconnect()
+	defer disconnect(t, &err)
 
-	notifyChar.EnableNotifications(func(buf []byte) {
-		fmt.Println("Received list image response:", string(buf))
-	})
+	t.EnableNotifications(printResponse("Received list image response:", codec.List))
 
-	err = writeHeader(writeChar, listImages)
+	err = sendRequest(t, &codec.ListRequest{})
 	if err != nil {
 		return err
 	}
-	time.Sleep(time.Second)
+	time.Sleep(responseWait)
 	return nil
 }
 
-func runGetFile(c *cli.Context) error {
-	device, writeChar, notifyChar, err := connectToPeripheral()
+func runGetFile(c *cli.Context) (err error) {
+	if len(c.Args()) != 1 {
+		return errors.New("Usage: get <name>")
+	}
+
+	t, err := connect(c)
 	if err != nil {
 		return err
 	}
-	defer device.Disconnect()
+	defer disconnect(t, &err)
 
-	notifyChar.EnableNotifications(func(buf []byte) {
-		fmt.Println("Received get image response:", string(buf))
-	})
+	t.EnableNotifications(printResponse("Received get image response:", codec.Get))
 
-	err = sendRequest(writeChar, getImage, []byte(c.Args()[0]))
+	err = sendRequest(t, &codec.GetRequest{Name: c.Args()[0]})
 	if err != nil {
 		return err
 	}
-	time.Sleep(time.Second)
+	time.Sleep(responseWait)
 	return nil
 }
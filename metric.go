@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// colorMetric decides which palette color is closest. Colors are converted
+// into the metric's space once, and quantization errors are measured and
+// diffused in that space too.
+type colorMetric struct {
+	name string
+	// toSpace converts sRGB channels in [0, 255].
+	toSpace  func(r, g, b float64) [3]float64
+	distance func(a, b [3]float64) float64
+	// lo and hi bound the space; diffused values are clamped to them.
+	lo, hi [3]float64
+
+	matchers sync.Map // palette key -> *paletteMatcher
+}
+
+func rgbSpace(r, g, b float64) [3]float64 {
+	return [3]float64{r, g, b}
+}
+
+func squaredDistance(a, b [3]float64) float64 {
+	d0, d1, d2 := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return d0*d0 + d1*d1 + d2*d2
+}
+
+// redmeanDistance weights the channels by how sensitive the eye is to them,
+// depending on how red the colors are.
+func redmeanDistance(a, b [3]float64) float64 {
+	rmean := (a[0] + b[0]) / 2
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return (2+rmean/256)*dr*dr + 4*dg*dg + (2+(255-rmean)/256)*db*db
+}
+
+const defaultMetric = "rgb"
+
+var (
+	rgbMetric = &colorMetric{
+		name:     "rgb",
+		toSpace:  rgbSpace,
+		distance: squaredDistance,
+		hi:       [3]float64{255, 255, 255},
+	}
+	metrics = map[string]*colorMetric{
+		"rgb": rgbMetric,
+		"weighted-rgb": {
+			name:     "weighted-rgb",
+			toSpace:  rgbSpace,
+			distance: redmeanDistance,
+			hi:       [3]float64{255, 255, 255},
+		},
+		"cie76": {
+			name:     "cie76",
+			toSpace:  srgbToLab,
+			distance: squaredDistance,
+			lo:       [3]float64{0, -128, -128},
+			hi:       [3]float64{100, 128, 128},
+		},
+		"ciede2000": {
+			name:     "ciede2000",
+			toSpace:  srgbToLab,
+			distance: ciede2000,
+			lo:       [3]float64{0, -128, -128},
+			hi:       [3]float64{100, 128, 128},
+		},
+		"oklab": {
+			name:     "oklab",
+			toSpace:  srgbToOklab,
+			distance: squaredDistance,
+			lo:       [3]float64{0, -0.4, -0.4},
+			hi:       [3]float64{1, 0.4, 0.4},
+		},
+	}
+)
+
+func metricNames() []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupMetric(name string) (*colorMetric, error) {
+	m, ok := metrics[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown color metric %q, available: %s", name,
+			strings.Join(metricNames(), ", "))
+	}
+	return m, nil
+}
+
+func (m *colorMetric) clamp(v [3]float64) [3]float64 {
+	for i := range v {
+		v[i] = math.Max(m.lo[i], math.Min(m.hi[i], v[i]))
+	}
+	return v
+}
+
+func (m *colorMetric) convert(c color.Color) [3]float64 {
+	r, g, b, _ := c.RGBA()
+	return m.toSpace(float64(r>>8), float64(g>>8), float64(b>>8))
+}
+
+// lutSteps is the number of lookup table cells per axis of a metric space.
+const lutSteps = 64
+
+// paletteMatcher finds the closest palette color under a metric. Except for
+// plain RGB, where an exact search is cheap, it answers from a lookup table
+// over the metric space filled once with the nearest color of each cell
+// center.
+type paletteMatcher struct {
+	metric *colorMetric
+	colors [][3]float64
+	lut    []uint8
+	// rgb is the exact 8 bit search of plain RGB
+	rgb *rgbLookup
+}
+
+// matcher returns the cached matcher of the metric for pal.
+func (m *colorMetric) matcher(pal color.Palette) *paletteMatcher {
+	var key strings.Builder
+	for _, c := range pal {
+		r, g, b, _ := c.RGBA()
+		fmt.Fprintf(&key, "%04x%04x%04x", r, g, b)
+	}
+	if pm, ok := m.matchers.Load(key.String()); ok {
+		return pm.(*paletteMatcher)
+	}
+
+	pm := &paletteMatcher{metric: m}
+	for _, c := range pal {
+		pm.colors = append(pm.colors, m.convert(c))
+	}
+	if m != rgbMetric {
+		pm.buildLUT()
+	} else {
+		pm.rgb = newRGBLookup(pal)
+	}
+	actual, _ := m.matchers.LoadOrStore(key.String(), pm)
+	return actual.(*paletteMatcher)
+}
+
+func (pm *paletteMatcher) buildLUT() {
+	m := pm.metric
+	pm.lut = make([]uint8, lutSteps*lutSteps*lutSteps)
+	var v [3]float64
+	for i := 0; i < lutSteps; i++ {
+		v[0] = m.lo[0] + (m.hi[0]-m.lo[0])*float64(i)/(lutSteps-1)
+		for j := 0; j < lutSteps; j++ {
+			v[1] = m.lo[1] + (m.hi[1]-m.lo[1])*float64(j)/(lutSteps-1)
+			for k := 0; k < lutSteps; k++ {
+				v[2] = m.lo[2] + (m.hi[2]-m.lo[2])*float64(k)/(lutSteps-1)
+				pm.lut[(i*lutSteps+j)*lutSteps+k] = uint8(pm.search(v))
+			}
+		}
+	}
+}
+
+func (pm *paletteMatcher) search(v [3]float64) int {
+	best, bestDist := 0, math.Inf(1)
+	for i, c := range pm.colors {
+		if d := pm.metric.distance(v, c); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+func (pm *paletteMatcher) cell(v float64, axis int) int {
+	m := pm.metric
+	i := int(math.Round((v - m.lo[axis]) / (m.hi[axis] - m.lo[axis]) * (lutSteps - 1)))
+	return max(0, min(lutSteps-1, i))
+}
+
+// nearest returns the palette index closest to v, given in metric space.
+func (pm *paletteMatcher) nearest(v [3]float64) int {
+	if pm.lut == nil {
+		return pm.search(v)
+	}
+	return int(pm.lut[(pm.cell(v[0], 0)*lutSteps+pm.cell(v[1], 1))*lutSteps+pm.cell(v[2], 2)])
+}
+
+// rgbCellBits is the number of high bits of each channel that select a cell
+// of rgbLookup.
+const rgbCellBits = 5
+
+// rgbLookup finds the palette color with the smallest squared RGB distance
+// to an 8 bit color, the first of equally close ones, without searching the
+// whole palette: each cell of the RGB cube lists only the colors that are
+// closest to some point in it, mostly just one.
+type rgbLookup struct {
+	colors [][3]int
+	// the candidates of cell c are list[start[c]:start[c+1]]
+	start []uint32
+	list  []uint8
+}
+
+func newRGBLookup(pal color.Palette) *rgbLookup {
+	l := &rgbLookup{}
+	for _, c := range pal {
+		r, g, b, _ := c.RGBA()
+		l.colors = append(l.colors, [3]int{int(r >> 8), int(g >> 8), int(b >> 8)})
+	}
+
+	const cells = 1 << rgbCellBits
+	const size = 256 / cells
+	l.start = make([]uint32, 0, cells*cells*cells+1)
+	nearDist := make([]int, len(l.colors))
+	for i := 0; i < cells*cells*cells; i++ {
+		lo := [3]int{i >> (2 * rgbCellBits) * size, i >> rgbCellBits % cells * size, i % cells * size}
+		// a color can only be closest somewhere in the cell if its nearest
+		// point is no farther than the farthest point of some other color
+		farthest := math.MaxInt
+		for j, c := range l.colors {
+			var near, far int
+			for k := range c {
+				d := max(lo[k]-c[k], c[k]-(lo[k]+size-1), 0)
+				near += d * d
+				f := max(c[k]-lo[k], lo[k]+size-1-c[k])
+				far += f * f
+			}
+			nearDist[j] = near
+			farthest = min(farthest, far)
+		}
+		l.start = append(l.start, uint32(len(l.list)))
+		for j := range l.colors {
+			if nearDist[j] <= farthest {
+				l.list = append(l.list, uint8(j))
+			}
+		}
+	}
+	l.start = append(l.start, uint32(len(l.list)))
+	return l
+}
+
+// nearest returns the palette index closest to r, g, b in [0, 255].
+func (l *rgbLookup) nearest(r, g, b int) int {
+	c := (r>>(8-rgbCellBits)<<rgbCellBits|g>>(8-rgbCellBits))<<rgbCellBits | b>>(8-rgbCellBits)
+	candidates := l.list[l.start[c]:l.start[c+1]]
+	if len(candidates) == 1 {
+		return int(candidates[0])
+	}
+	best, bestDist := 0, math.MaxInt
+	for _, i := range candidates {
+		p := &l.colors[i]
+		dr, dg, db := r-p[0], g-p[1], b-p[2]
+		if d := dr*dr + dg*dg + db*db; d < bestDist {
+			best, bestDist = int(i), d
+		}
+	}
+	return best
+}
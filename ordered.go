@@ -0,0 +1,195 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// orderedSpread is how far, per channel, a threshold can push a pixel
+// towards a neighbouring palette color.
+const orderedSpread = 128
+
+// thresholdMap tiles the image with thresholds in [0, 1).
+type thresholdMap struct {
+	size   int
+	values []float64
+}
+
+func (m *thresholdMap) at(x, y int) float64 {
+	return m.values[(y%m.size)*m.size+x%m.size]
+}
+
+// bayerMatrix builds the size x size Bayer index matrix, size being a power
+// of two, by repeatedly tiling M into [4M, 4M+2; 4M+3, 4M+1].
+func bayerMatrix(size int) *thresholdMap {
+	ranks := []int{0}
+	for n := 1; n < size; n *= 2 {
+		next := make([]int, 4*n*n)
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				r := 4 * ranks[y*n+x]
+				next[y*2*n+x] = r
+				next[y*2*n+x+n] = r + 2
+				next[(y+n)*2*n+x] = r + 3
+				next[(y+n)*2*n+x+n] = r + 1
+			}
+		}
+		ranks = next
+	}
+	return rankMap(size, ranks)
+}
+
+// rankMap turns a permutation of 0..size*size-1 into centered thresholds.
+func rankMap(size int, ranks []int) *thresholdMap {
+	m := &thresholdMap{size: size, values: make([]float64, len(ranks))}
+	for i, r := range ranks {
+		m.values[i] = (float64(r) + 0.5) / float64(len(ranks))
+	}
+	return m
+}
+
+const (
+	blueNoiseSize  = 64
+	blueNoiseSigma = 1.5
+)
+
+var (
+	blueNoiseOnce sync.Once
+	blueNoise     *thresholdMap
+)
+
+// blueNoiseMap returns a blue noise threshold map generated once with the
+// void-and-cluster method.
+func blueNoiseMap() *thresholdMap {
+	blueNoiseOnce.Do(func() {
+		blueNoise = rankMap(blueNoiseSize, voidAndCluster(blueNoiseSize, blueNoiseSigma))
+	})
+	return blueNoise
+}
+
+// voidAndCluster ranks the cells of a size x size torus so that every prefix
+// of the ranking is an evenly spread point set (Ulichney, 1993).
+func voidAndCluster(size int, sigma float64) []int {
+	n := size * size
+
+	// toroidal Gaussian filter, indexed by wrapped offset
+	kernel := make([]float64, n)
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			wx := float64(min(dx, size-dx))
+			wy := float64(min(dy, size-dy))
+			kernel[dy*size+dx] = math.Exp(-(wx*wx + wy*wy) / (2 * sigma * sigma))
+		}
+	}
+
+	ones := make([]bool, n)
+	energy := make([]float64, n)
+	toggle := func(i int, on bool) {
+		ones[i] = on
+		sign := 1.0
+		if !on {
+			sign = -1
+		}
+		px, py := i%size, i/size
+		for y := 0; y < size; y++ {
+			dy := (y - py + size) % size
+			for x := 0; x < size; x++ {
+				dx := (x - px + size) % size
+				energy[y*size+x] += sign * kernel[dy*size+dx]
+			}
+		}
+	}
+	// tightest cluster is the densest 1, largest void the emptiest 0
+	extreme := func(want bool, densest bool) int {
+		best := -1
+		for i := 0; i < n; i++ {
+			if ones[i] != want {
+				continue
+			}
+			if best < 0 || (densest && energy[i] > energy[best]) || (!densest && energy[i] < energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// initial pattern: random points, relaxed until moving the tightest
+	// cluster into the largest void changes nothing
+	rng := rand.New(rand.NewSource(1))
+	initial := n / 10
+	for count := 0; count < initial; {
+		i := rng.Intn(n)
+		if !ones[i] {
+			toggle(i, true)
+			count++
+		}
+	}
+	for {
+		cluster := extreme(true, true)
+		toggle(cluster, false)
+		void := extreme(false, false)
+		if void == cluster {
+			toggle(cluster, true)
+			break
+		}
+		toggle(void, true)
+	}
+	prototype := append([]bool{}, ones...)
+	prototypeEnergy := append([]float64{}, energy...)
+
+	ranks := make([]int, n)
+	// phase 1: remove the tightest clusters, ranking downwards
+	for rank := initial - 1; rank >= 0; rank-- {
+		i := extreme(true, true)
+		toggle(i, false)
+		ranks[i] = rank
+	}
+
+	// phase 2: fill the largest voids, ranking upwards
+	copy(ones, prototype)
+	copy(energy, prototypeEnergy)
+	for rank := initial; rank < n; rank++ {
+		i := extreme(false, false)
+		toggle(i, true)
+		ranks[i] = rank
+	}
+	return ranks
+}
+
+func thresholdDither(m func() *thresholdMap) ditherer {
+	return func(img image.Image, cfg *ditherConfig) *image.Paletted {
+		return orderedDither(img, m(), cfg.metric, cfg.palette)
+	}
+}
+
+// orderedDither offsets every pixel by its threshold before picking the
+// closest palette color. Pixels are independent, so there is no error to
+// carry and no directional artifacts.
+func orderedDither(img image.Image, m *thresholdMap, metric *colorMetric,
+	p *paletteProfile) *image.Paletted {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	rgba := image.NewNRGBA64(bounds)
+	draw.Draw(rgba, bounds, img, bounds.Min, draw.Src)
+
+	pal := p.colors()
+	pm := metric.matcher(pal)
+	dithered := image.NewPaletted(bounds, pal)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*rgba.Stride + x*8
+			offset := float64(int((m.at(x, y) - 0.5) * orderedSpread))
+			idx := pm.nearest(metric.toSpace(
+				math.Max(0, math.Min(255, channel16(rgba.Pix, i)+offset)),
+				math.Max(0, math.Min(255, channel16(rgba.Pix, i+2)+offset)),
+				math.Max(0, math.Min(255, channel16(rgba.Pix, i+4)+offset)),
+			))
+			dithered.Pix[y*dithered.Stride+x] = uint8(idx)
+		}
+	}
+	return dithered
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"image"
+)
+
+const (
+	orientationAuto      = "auto"
+	orientationLandscape = "landscape"
+	orientationPortrait  = "portrait"
+)
+
+// placement is how an image is viewed on a panel: its size as seen, and the
+// clockwise quarter turns that bring it into the panel's scan order.
+type placement struct {
+	width, height int
+	turns         int
+}
+
+// placeImage works out the placement from the --orientation and --rotate
+// values, rotate being -1 if unset. An auto orientation follows the shape of
+// src or, when src is empty, the rotation. Without a rotation, a view that
+// differs from the panel's orientation is turned 90 degrees clockwise.
+func placeImage(panel *panelProfile, orientation string, rotate int, src image.Rectangle) (*placement, error) {
+	native := orientationLandscape
+	if panel.height > panel.width {
+		native = orientationPortrait
+	}
+
+	switch orientation {
+	case orientationAuto, "":
+		orientation = native
+		if src.Empty() && (rotate == 90 || rotate == 270) {
+			orientation = orientationPortrait
+			if native == orientationPortrait {
+				orientation = orientationLandscape
+			}
+		} else if !src.Empty() {
+			orientation = orientationLandscape
+			if src.Dy() > src.Dx() {
+				orientation = orientationPortrait
+			}
+		}
+	case orientationLandscape, orientationPortrait:
+	default:
+		return nil, fmt.Errorf("unknown orientation %q, available: %s, %s, %s", orientation,
+			orientationAuto, orientationLandscape, orientationPortrait)
+	}
+
+	var turns int
+	switch rotate {
+	case -1:
+		if orientation != native {
+			turns = 1
+		}
+	case 0, 90, 180, 270:
+		turns = rotate / 90
+		if (turns%2 == 1) != (orientation != native) {
+			want := "0 or 180"
+			if orientation != native {
+				want = "90 or 270"
+			}
+			return nil, fmt.Errorf("a %s image needs a rotation of %s on the %s panel %s",
+				orientation, want, native, panel.name)
+		}
+	default:
+		return nil, fmt.Errorf("rotation must be 0, 90, 180 or 270, not %d", rotate)
+	}
+
+	p := &placement{width: panel.width, height: panel.height, turns: turns}
+	if turns%2 == 1 {
+		p.width, p.height = panel.height, panel.width
+	}
+	return p, nil
+}
+
+// rotate turns img clockwise by the given number of quarter turns.
+func rotate(img *image.Paletted, turns int) *image.Paletted {
+	turns = (turns%4 + 4) % 4
+	if turns == 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if turns%2 == 1 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewPaletted(image.Rect(0, 0, dstW, dstH), img.Palette)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch turns {
+			case 1:
+				dx, dy = h-1-y, x
+			case 2:
+				dx, dy = w-1-x, h-1-y
+			case 3:
+				dx, dy = y, w-1-x
+			}
+			dst.Pix[dy*dst.Stride+dx] = img.Pix[y*img.Stride+x]
+		}
+	}
+	return dst
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+	"strings"
+)
+
+// paletteEntry is one ink of a panel. color is what the panel actually
+// shows, which is what pixels are matched against and what the error is
+// computed from. index is the value written to the e-paper data.
+type paletteEntry struct {
+	name  string
+	color color.RGBA
+	index byte
+}
+
+// paletteProfile lists the inks of a panel in matching order.
+type paletteProfile struct {
+	name    string
+	entries []paletteEntry
+}
+
+// colors returns the display colors, in entry order.
+func (p *paletteProfile) colors() color.Palette {
+	pal := make(color.Palette, len(p.entries))
+	for i, e := range p.entries {
+		pal[i] = e.color
+	}
+	return pal
+}
+
+func (p *paletteProfile) hasIndex(index byte) bool {
+	for _, e := range p.entries {
+		if e.index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns the entry with the given name.
+func (p *paletteProfile) entry(name string) (paletteEntry, error) {
+	names := make([]string, len(p.entries))
+	for i, e := range p.entries {
+		if e.name == name {
+			return e, nil
+		}
+		names[i] = e.name
+	}
+	return paletteEntry{}, fmt.Errorf("palette %s has no color %q, available: %s", p.name, name,
+		strings.Join(names, ", "))
+}
+
+// position returns the position of the entry written as index, for decoding
+// e-paper data. Unknown indices decode as the first entry.
+func (p *paletteProfile) position(index byte) uint8 {
+	for i, e := range p.entries {
+		if e.index == index {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+var palettes = map[string]*paletteProfile{
+	// the nominal ACeP colors
+	"acep7": {
+		name: "acep7",
+		entries: []paletteEntry{
+			{"black", color.RGBA{0, 0, 0, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+			{"green", color.RGBA{0, 255, 0, 255}, 2},
+			{"blue", color.RGBA{0, 0, 255, 255}, 3},
+			{"red", color.RGBA{255, 0, 0, 255}, 4},
+			{"yellow", color.RGBA{255, 255, 0, 255}, 5},
+			{"orange", color.RGBA{255, 128, 0, 255}, 6},
+		},
+	},
+	// ACeP 7-color panel as measured under daylight, as published with
+	// Pimoroni's Inky Impression driver
+	"acep7-measured": {
+		name: "acep7-measured",
+		entries: []paletteEntry{
+			{"black", color.RGBA{57, 48, 57, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+			{"green", color.RGBA{58, 91, 70, 255}, 2},
+			{"blue", color.RGBA{61, 59, 94, 255}, 3},
+			{"red", color.RGBA{156, 72, 75, 255}, 4},
+			{"yellow", color.RGBA{208, 190, 71, 255}, 5},
+			{"orange", color.RGBA{177, 106, 73, 255}, 6},
+		},
+	},
+	"bw": {
+		name: "bw",
+		entries: []paletteEntry{
+			{"black", color.RGBA{0, 0, 0, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+		},
+	},
+	"bwr": {
+		name: "bwr",
+		entries: []paletteEntry{
+			{"black", color.RGBA{0, 0, 0, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+			{"red", color.RGBA{255, 0, 0, 255}, 2},
+		},
+	},
+	"bwry": {
+		name: "bwry",
+		entries: []paletteEntry{
+			{"black", color.RGBA{0, 0, 0, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+			{"yellow", color.RGBA{255, 255, 0, 255}, 2},
+			{"red", color.RGBA{255, 0, 0, 255}, 3},
+		},
+	},
+	// E Ink Spectra 6; index 4 is unused by the panel
+	"spectra6": {
+		name: "spectra6",
+		entries: []paletteEntry{
+			{"black", color.RGBA{0, 0, 0, 255}, 0},
+			{"white", color.RGBA{255, 255, 255, 255}, 1},
+			{"yellow", color.RGBA{255, 255, 0, 255}, 2},
+			{"red", color.RGBA{255, 0, 0, 255}, 3},
+			{"blue", color.RGBA{0, 0, 255, 255}, 5},
+			{"green", color.RGBA{0, 255, 0, 255}, 6},
+		},
+	},
+	// Spectra 6 colors as commonly measured on 7.3" panels
+	"spectra6-measured": {
+		name: "spectra6-measured",
+		entries: []paletteEntry{
+			{"black", color.RGBA{25, 30, 33, 255}, 0},
+			{"white", color.RGBA{232, 232, 232, 255}, 1},
+			{"yellow", color.RGBA{239, 222, 68, 255}, 2},
+			{"red", color.RGBA{178, 19, 24, 255}, 3},
+			{"blue", color.RGBA{33, 87, 186, 255}, 5},
+			{"green", color.RGBA{18, 95, 32, 255}, 6},
+		},
+	},
+}
+
+func paletteNames() []string {
+	names := make([]string, 0, len(palettes))
+	for name := range palettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPalette(name string) (*paletteProfile, error) {
+	p, ok := palettes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown palette %q, available: %s", name,
+			strings.Join(paletteNames(), ", "))
+	}
+	return p, nil
+}
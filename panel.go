@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+)
+
+// pixelEncoding packs palette indices into the bytes a panel driver loads.
+// Rows start on a byte boundary.
+type pixelEncoding struct {
+	name string
+	size func(width, height int) int
+	set  func(data []byte, width, x, y int, index byte)
+	get  func(data []byte, width, x, y int) byte
+}
+
+var (
+	// two pixels per byte, the left one in the high nibble
+	encoding4bpp = &pixelEncoding{
+		name: "4bpp",
+		size: func(width, height int) int {
+			return (width + 1) / 2 * height
+		},
+		set: func(data []byte, width, x, y int, index byte) {
+			i := x/2 + y*((width+1)/2)
+			shift := 4 - (x%2)*4
+			data[i] = data[i]&^(0x0F<<shift) | (index&0x0F)<<shift
+		},
+		get: func(data []byte, width, x, y int) byte {
+			i := x/2 + y*((width+1)/2)
+			shift := 4 - (x%2)*4
+			return data[i] >> shift & 0x0F
+		},
+	}
+	// four pixels per byte, the left one in the top two bits
+	encoding2bpp = &pixelEncoding{
+		name: "2bpp",
+		size: func(width, height int) int {
+			return (width + 3) / 4 * height
+		},
+		set: func(data []byte, width, x, y int, index byte) {
+			i := x/4 + y*((width+3)/4)
+			shift := 6 - (x%4)*2
+			data[i] = data[i]&^(0x03<<shift) | (index&0x03)<<shift
+		},
+		get: func(data []byte, width, x, y int) byte {
+			i := x/4 + y*((width+3)/4)
+			shift := 6 - (x%4)*2
+			return data[i] >> shift & 0x03
+		},
+	}
+	// eight pixels per byte, the left one in the top bit
+	encoding1bpp = &pixelEncoding{
+		name: "1bpp",
+		size: func(width, height int) int {
+			return (width + 7) / 8 * height
+		},
+		set: func(data []byte, width, x, y int, index byte) {
+			setBit(data, x/8+y*((width+7)/8), x, index&1 != 0)
+		},
+		get: func(data []byte, width, x, y int) byte {
+			return getBit(data, x/8+y*((width+7)/8), x)
+		},
+	}
+	// a 1bpp black/white plane (1 = white) followed by a 1bpp color plane
+	// (0 = color), as loaded by three color panels. Index 0 is black, 1
+	// white and 2 the third color.
+	encodingPlanes = &pixelEncoding{
+		name: "1bpp-planes",
+		size: func(width, height int) int {
+			return 2 * ((width + 7) / 8) * height
+		},
+		set: func(data []byte, width, x, y int, index byte) {
+			i := x/8 + y*((width+7)/8)
+			// data holds exactly both planes
+			plane := len(data) / 2
+			setBit(data, i, x, index != 0)
+			setBit(data, plane+i, x, index != 2)
+		},
+		get: func(data []byte, width, x, y int) byte {
+			i := x/8 + y*((width+7)/8)
+			plane := len(data) / 2
+			switch {
+			case getBit(data, plane+i, x) == 0:
+				return 2
+			default:
+				return getBit(data, i, x)
+			}
+		},
+	}
+)
+
+func setBit(data []byte, i, x int, on bool) {
+	mask := byte(0x80) >> (x % 8)
+	if on {
+		data[i] |= mask
+	} else {
+		data[i] &^= mask
+	}
+}
+
+func getBit(data []byte, i, x int) byte {
+	return data[i] >> (7 - x%8) & 1
+}
+
+// panelProfile describes an e-paper panel: its resolution, its default
+// palette and how the palette indices are packed.
+type panelProfile struct {
+	name          string
+	width, height int
+	palette       string
+	encoding      *pixelEncoding
+}
+
+const defaultPanel = "acep7"
+
+var panels = map[string]*panelProfile{
+	// 7.3" ACeP
+	"acep7": {name: "acep7", width: 800, height: 480, palette: "acep7", encoding: encoding4bpp},
+	// 5.65" ACeP
+	"acep7-5.65": {name: "acep7-5.65", width: 600, height: 448, palette: "acep7", encoding: encoding4bpp},
+	// 4" ACeP
+	"acep7-4": {name: "acep7-4", width: 640, height: 400, palette: "acep7", encoding: encoding4bpp},
+	// 7.3" Spectra 6
+	"spectra6": {name: "spectra6", width: 800, height: 480, palette: "spectra6", encoding: encoding4bpp},
+	// 7.3" black, white, yellow and red
+	"bwry": {name: "bwry", width: 800, height: 480, palette: "bwry", encoding: encoding2bpp},
+	// 7.5" black, white and red
+	"bwr": {name: "bwr", width: 800, height: 480, palette: "bwr", encoding: encodingPlanes},
+	// 12.48" black, white and red
+	"bwr-12.48": {name: "bwr-12.48", width: 1304, height: 984, palette: "bwr", encoding: encodingPlanes},
+	// 7.5" black and white
+	"bw": {name: "bw", width: 800, height: 480, palette: "bw", encoding: encoding1bpp},
+	// 12.48" black and white
+	"bw-12.48": {name: "bw-12.48", width: 1304, height: 984, palette: "bw", encoding: encoding1bpp},
+}
+
+func panelNames() []string {
+	names := make([]string, 0, len(panels))
+	for name := range panels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPanel(name string) (*panelProfile, error) {
+	p, ok := panels[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown panel %q, available: %s", name,
+			strings.Join(panelNames(), ", "))
+	}
+	return p, nil
+}
+
+// lookupPanelPalette returns the panel and the palette to use with it, the
+// panel's own unless paletteName is set. A palette may only use the indices
+// the panel knows.
+func lookupPanelPalette(panelName, paletteName string) (*panelProfile, *paletteProfile, error) {
+	panel, err := lookupPanel(panelName)
+	if err != nil {
+		return nil, nil, err
+	}
+	native, err := lookupPalette(panel.palette)
+	if err != nil {
+		return nil, nil, err
+	}
+	if paletteName == "" || paletteName == native.name {
+		return panel, native, nil
+	}
+
+	pal, err := lookupPalette(paletteName)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range pal.entries {
+		if !native.hasIndex(e.index) {
+			return nil, nil, fmt.Errorf("palette %s uses index %d which panel %s does not have",
+				pal.name, e.index, panel.name)
+		}
+	}
+	return panel, pal, nil
+}
+
+// encode packs the palette indices of img, whose colors are the entries of
+// pal in order.
+func (p *panelProfile) encode(img *image.Paletted, pal *paletteProfile) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	data := make([]byte, p.encoding.size(width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			e := pal.entries[img.Pix[y*img.Stride+x]]
+			p.encoding.set(data, width, x, y, e.index)
+		}
+	}
+	return data
+}
+
+// decode unpacks data of a full panel image into the colors of pal.
+func (p *panelProfile) decode(data []byte, pal *paletteProfile) (*image.Paletted, error) {
+	width, height := p.width, p.height
+	size := p.encoding.size(width, height)
+	if len(data) < size {
+		return nil, fmt.Errorf("raw data has %d bytes, %s %dx%d needs %d",
+			len(data), p.name, width, height, size)
+	}
+	// trailing bytes are ignored, and must not shift the planes of
+	// encodingPlanes, which split the data in half
+	data = data[:size]
+	img := image.NewPaletted(image.Rect(0, 0, width, height), pal.colors())
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Pix[y*img.Stride+x] = pal.position(p.encoding.get(data, width, x, y))
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"reflect"
+	"testing"
+)
+
+// panelTestImage fills a width x height image with a pattern using every
+// entry of pal.
+func panelTestImage(pal *paletteProfile, width, height int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, width, height), pal.colors())
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Pix[y*img.Stride+x] = uint8((x*7 + y*13 + x*y) % len(pal.entries))
+		}
+	}
+	return img
+}
+
+func TestPanelRoundTrip(t *testing.T) {
+	bitsPerPixel := map[*pixelEncoding]int{
+		encoding4bpp:   4,
+		encoding2bpp:   2,
+		encoding1bpp:   1,
+		encodingPlanes: 2,
+	}
+	for _, name := range panelNames() {
+		p := panels[name]
+		pal, err := lookupPalette(p.palette)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := panelTestImage(pal, p.width, p.height)
+		data := p.encode(img, pal)
+		if want := p.width * p.height * bitsPerPixel[p.encoding] / 8; len(data) != want {
+			t.Errorf("%s: encoded %d bytes, want %d", name, len(data), want)
+		}
+
+		got, err := p.decode(data, pal)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%s: decoded image differs from the encoded one", name)
+		}
+
+		// trailing bytes, e.g. padding from a driver's buffer, are ignored
+		got, err = p.decode(append(data, bytes.Repeat([]byte{0xA5}, 100)...), pal)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got.Pix, img.Pix) {
+			t.Errorf("%s: trailing bytes changed the decoded image", name)
+		}
+
+		if _, err := p.decode(data[:len(data)-1], pal); err == nil {
+			t.Errorf("%s: decoded short data", name)
+		}
+	}
+}
+
+// Rows start on a byte boundary, also when the width does not fill the last
+// byte.
+func TestEncodingOddWidth(t *testing.T) {
+	for _, tc := range []struct {
+		encoding *pixelEncoding
+		palette  string
+		size     int
+	}{
+		{encoding4bpp, "acep7", 7 * 3},
+		{encoding2bpp, "bwry", 4 * 3},
+		{encoding1bpp, "bw", 2 * 3},
+		{encodingPlanes, "bwr", 2 * 2 * 3},
+	} {
+		pal, err := lookupPalette(tc.palette)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &panelProfile{name: tc.encoding.name, width: 13, height: 3, encoding: tc.encoding}
+		img := panelTestImage(pal, p.width, p.height)
+		data := p.encode(img, pal)
+		if len(data) != tc.size {
+			t.Errorf("%s: encoded %d bytes, want %d", tc.encoding.name, len(data), tc.size)
+		}
+		got, err := p.decode(data, pal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Pix, img.Pix) {
+			t.Errorf("%s: got %v, want %v", tc.encoding.name, got.Pix, img.Pix)
+		}
+	}
+}
+
+// Three color panels load a black/white plane (1 = white) and a color plane
+// in which 0 marks the red pixels.
+func TestPlanesPolarity(t *testing.T) {
+	pal, err := lookupPalette("bwr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := func(name string) uint8 {
+		e, err := pal.entry(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pal.position(e.index)
+	}
+	p := &panelProfile{name: "bwr", width: 8, height: 1, encoding: encodingPlanes}
+	img := image.NewPaletted(image.Rect(0, 0, 8, 1), pal.colors())
+	copy(img.Pix, []uint8{pos("black"), pos("white"), pos("red"), pos("white"), pos("black"), pos("red"), pos("red"), pos("black")})
+
+	data := p.encode(img, pal)
+	// black/white plane 0111 0110, red under white; color plane 1101 1001
+	if want := []byte{0x76, 0xD9}; !bytes.Equal(data, want) {
+		t.Errorf("encoded %08b, want %08b", data, want)
+	}
+
+	// a cleared color plane is red wherever the other plane says
+	got, err := p.decode([]byte{0x0F, 0x00}, pal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x, c := range got.Pix {
+		if c != pos("red") {
+			t.Errorf("pixel %d decoded as %s, want red", x, pal.entries[c].name)
+		}
+	}
+}
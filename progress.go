@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	progressAuto = "auto"
+	progressBar  = "bar"
+	progressJSON = "json"
+	progressNone = "none"
+
+	progressBarWidth = 30
+)
+
+// progress reports how far a transfer is. On a terminal it redraws a single
+// bar line, otherwise it writes one JSON object per update so scripts can
+// follow along.
+type progress struct {
+	out    io.Writer
+	mode   string
+	total  int
+	sent   int
+	frames int
+
+	retransmits int
+	start       time.Time
+	lastReport  time.Time
+}
+
+type progressEvent struct {
+	Event       string  `json:"event"`
+	Sent        int     `json:"sent"`
+	Total       int     `json:"total"`
+	Percent     float64 `json:"percent"`
+	BytesPerSec float64 `json:"bytes_per_sec"`
+	ETASec      float64 `json:"eta_sec"`
+	Frames      int     `json:"frames"`
+	Retransmits int     `json:"retransmits"`
+	ElapsedSec  float64 `json:"elapsed_sec"`
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(mode string, total int) (*progress, error) {
+	switch mode {
+	case progressAuto, "":
+		mode = progressJSON
+		if isTerminal(os.Stderr) {
+			mode = progressBar
+		}
+	case progressBar, progressJSON, progressNone:
+	default:
+		return nil, fmt.Errorf("unknown progress mode %q, use auto, bar, json or none", mode)
+	}
+
+	now := time.Now()
+	return &progress{
+		out:   os.Stderr,
+		mode:  mode,
+		total: total,
+		start: now,
+	}, nil
+}
+
+// add records n more bytes as sent in one frame.
+func (p *progress) add(n int) {
+	p.sent += n
+	p.frames++
+
+	now := time.Now()
+	if p.sent < p.total && now.Sub(p.lastReport) < 200*time.Millisecond {
+		return
+	}
+	p.lastReport = now
+	p.report("progress", now)
+}
+
+// retransmit records one frame that had to be written again.
+func (p *progress) retransmit() {
+	p.retransmits++
+}
+
+// finish prints the transfer summary.
+func (p *progress) finish() {
+	now := time.Now()
+	switch p.mode {
+	case progressBar:
+		fmt.Fprintln(p.out)
+		fallthrough
+	case progressNone:
+		elapsed := now.Sub(p.start)
+		fmt.Fprintf(p.out, "Sent %s in %s, %d frames, %d retransmits, %s/s effective\n",
+			formatBytes(float64(p.sent)), elapsed.Round(time.Millisecond), p.frames,
+			p.retransmits, formatBytes(p.rate(now)))
+	case progressJSON:
+		p.report("summary", now)
+	}
+}
+
+func (p *progress) rate(now time.Time) float64 {
+	elapsed := now.Sub(p.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.sent) / elapsed
+}
+
+func (p *progress) report(event string, now time.Time) {
+	var percent, eta float64
+	if p.total > 0 {
+		percent = 100 * float64(p.sent) / float64(p.total)
+	}
+	rate := p.rate(now)
+	if rate > 0 {
+		eta = float64(p.total-p.sent) / rate
+	}
+
+	switch p.mode {
+	case progressBar:
+		filled := progressBarWidth * p.sent / max(p.total, 1)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+		fmt.Fprintf(p.out, "\r[%s] %5.1f%% %s/%s %s/s ETA %s ", bar, percent,
+			formatBytes(float64(p.sent)), formatBytes(float64(p.total)), formatBytes(rate),
+			time.Duration(eta*float64(time.Second)).Round(time.Second))
+	case progressJSON:
+		json.NewEncoder(p.out).Encode(progressEvent{
+			Event:       event,
+			Sent:        p.sent,
+			Total:       p.total,
+			Percent:     percent,
+			BytesPerSec: rate,
+			ETASec:      eta,
+			Frames:      p.frames,
+			Retransmits: p.retransmits,
+			ElapsedSec:  now.Sub(p.start).Seconds(),
+		})
+	}
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", n/(1<<10))
+	default:
+		return fmt.Sprintf("%.0fB", n)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// replayTransport plays a recorded session back. Each write has to match the
+// next recorded write, and the notifications recorded after it are then
+// delivered to the callback before Write returns.
+type replayTransport struct {
+	mu       sync.Mutex
+	records  []traceRecord
+	next     int
+	callback func(buf []byte)
+	pending  [][]byte
+}
+
+func openReplay(filename string) (*replayTransport, error) {
+	records, err := readTrace(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newReplayTransport(records)
+}
+
+func newReplayTransport(records []traceRecord) (*replayTransport, error) {
+	for i := range records {
+		if _, err := records[i].payload(); err != nil {
+			return nil, fmt.Errorf("replay record %d: %v", i+1, err)
+		}
+		if records[i].Dir != traceWrite && records[i].Dir != traceNotify {
+			return nil, fmt.Errorf("replay record %d: unknown direction %q", i+1, records[i].Dir)
+		}
+	}
+	return &replayTransport{records: records}, nil
+}
+
+func (t *replayTransport) Write(frame []byte) error {
+	t.mu.Lock()
+	// notifications recorded before the first write, e.g. a greeting
+	t.queueNotifications()
+
+	if t.next >= len(t.records) {
+		t.mu.Unlock()
+		return fmt.Errorf("replay: unexpected write %s after the end of the recording",
+			hexPreview(frame, false))
+	}
+	r := t.records[t.next]
+	want, _ := r.payload()
+	if !bytes.Equal(want, frame) {
+		t.mu.Unlock()
+		return fmt.Errorf("replay: write %d mismatch: recorded %s (%dB), got %s (%dB)",
+			t.next+1, hexPreview(want, false), len(want), hexPreview(frame, false), len(frame))
+	}
+	t.next++
+	t.queueNotifications()
+	t.mu.Unlock()
+
+	t.deliver()
+	return nil
+}
+
+// queueNotifications moves the notifications following the current position
+// to the pending queue.
+func (t *replayTransport) queueNotifications() {
+	for t.next < len(t.records) && t.records[t.next].Dir == traceNotify {
+		buf, _ := t.records[t.next].payload()
+		t.pending = append(t.pending, buf)
+		t.next++
+	}
+}
+
+func (t *replayTransport) deliver() {
+	t.mu.Lock()
+	callback := t.callback
+	if callback == nil {
+		t.mu.Unlock()
+		return
+	}
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for _, buf := range pending {
+		callback(buf)
+	}
+}
+
+func (t *replayTransport) EnableNotifications(callback func(buf []byte)) error {
+	t.mu.Lock()
+	t.callback = callback
+	t.mu.Unlock()
+
+	t.deliver()
+	return nil
+}
+
+func (t *replayTransport) Disconnect() error {
+	return t.finish()
+}
+
+// finish reports recorded frames that were never replayed.
+func (t *replayTransport) finish() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.next < len(t.records) {
+		r := t.records[t.next]
+		return fmt.Errorf("replay: %d of %d records left, next is %s %s %s",
+			len(t.records)-t.next, len(t.records), r.Dir, r.Method, r.Kind)
+	}
+	if len(t.pending) > 0 {
+		return fmt.Errorf("replay: %d notifications were never delivered", len(t.pending))
+	}
+	return nil
+}
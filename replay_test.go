@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+// runReplay runs the CLI with args against the recorded session and returns
+// what the command printed.
+func runReplay(t *testing.T, recording string, args ...string) (string, *replayTransport, error) {
+	t.Helper()
+
+	oldDial, oldWriteDelay, oldResponseWait := dial, writeDelay, responseWait
+	t.Cleanup(func() {
+		dial, writeDelay, responseWait = oldDial, oldWriteDelay, oldResponseWait
+	})
+	writeDelay, responseWait = 0, 0
+
+	rt, err := openReplay(recording)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial = func(*cli.Context) (transport, error) {
+		return rt, nil
+	}
+
+	out, err := captureStdout(t, func() error {
+		return newApp().Run(append([]string{"blecli"}, args...))
+	})
+	return out, rt, err
+}
+
+func TestReplayUpload(t *testing.T) {
+	out, rt, err := runReplay(t, "testdata/upload.jsonl", "upload",
+		"--chunk-size", "32", "--chunk-delay", "0", "--progress", "none", "testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Received upload response: ACK:OK") {
+		t.Errorf("upload response not printed, output:\n%s", out)
+	}
+}
+
+// The default chunk size fits the default MTU, so the request header is
+// split over two writes.
+func TestReplayUploadDefaultChunks(t *testing.T) {
+	out, rt, err := runReplay(t, "testdata/upload-mtu23.jsonl", "upload",
+		"--chunk-delay", "0", "--progress", "none", "testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Received upload response: ACK:OK") {
+		t.Errorf("upload response not printed, output:\n%s", out)
+	}
+}
+
+func TestReplayUploadMismatch(t *testing.T) {
+	_, _, err := runReplay(t, "testdata/upload.jsonl", "upload",
+		"--chunk-size", "64", "--chunk-delay", "0", "--progress", "none", "testdata/hello.txt")
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatalf("expected a write mismatch, got %v", err)
+	}
+}
+
+func TestReplayList(t *testing.T) {
+	out, rt, err := runReplay(t, "testdata/list.jsonl", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.finish(); err != nil {
+		t.Fatal(err)
+	}
+	want := "Received list image response: 3a1f0c9e2b7d4a6f8e5c1b0d9a7f3e2c,192000;boot.py,412"
+	if !strings.Contains(out, want) {
+		t.Errorf("list response not printed, output:\n%s", out)
+	}
+}
+
+func TestReplayLeftoverRecords(t *testing.T) {
+	// the list session followed by a request list never sends
+	data, err := os.ReadFile("testdata/list.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, `{"time":"2026-10-19T09:30:01.000Z","dir":"write","kind":"request","method":"echo","len":6,"hex":"0070696e6721"}`+"\n"...)
+	recording := filepath.Join(t.TempDir(), "list.jsonl")
+	if err := os.WriteFile(recording, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = runReplay(t, recording, "list")
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 records left") {
+		t.Fatalf("expected an error for records that were never replayed, got %v", err)
+	}
+}
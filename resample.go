@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+)
+
+// resampleFilter is a separable reconstruction kernel. The original nearest
+// neighbor resize has no kernel.
+type resampleFilter struct {
+	name    string
+	support float64
+	kernel  func(x float64) float64
+}
+
+func boxKernel(x float64) float64 {
+	if x >= -0.5 && x < 0.5 {
+		return 1
+	}
+	return 0
+}
+
+func triangleKernel(x float64) float64 {
+	x = math.Abs(x)
+	if x < 1 {
+		return 1 - x
+	}
+	return 0
+}
+
+// catmullRomKernel is the cubic convolution kernel with a = -0.5.
+func catmullRomKernel(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x < 1:
+		return (1.5*x-2.5)*x*x + 1
+	case x < 2:
+		return ((-0.5*x+2.5)*x-4)*x + 2
+	}
+	return 0
+}
+
+func lanczos3Kernel(x float64) float64 {
+	x = math.Abs(x)
+	switch {
+	case x == 0:
+		return 1
+	case x < 3:
+		px := math.Pi * x
+		return 3 * math.Sin(px) * math.Sin(px/3) / (px * px)
+	}
+	return 0
+}
+
+const defaultResample = "nearest"
+
+var resampleFilters = map[string]*resampleFilter{
+	"nearest":  {name: "nearest"},
+	"box":      {name: "box", support: 0.5, kernel: boxKernel},
+	"bilinear": {name: "bilinear", support: 1, kernel: triangleKernel},
+	"bicubic":  {name: "bicubic", support: 2, kernel: catmullRomKernel},
+	"lanczos3": {name: "lanczos3", support: 3, kernel: lanczos3Kernel},
+}
+
+func resampleNames() []string {
+	names := make([]string, 0, len(resampleFilters))
+	for name := range resampleFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupResample(name string) (*resampleFilter, error) {
+	f, ok := resampleFilters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown resample filter %q, available: %s", name,
+			strings.Join(resampleNames(), ", "))
+	}
+	return f, nil
+}
+
+// resample scales src to dstW x dstH with filter f, in linear light. Source
+// rows are read one at a time, so memory grows with the output width rather
+// than the source size.
+func (f *resampleFilter) resample(src image.Image, dstW, dstH int) image.Image {
+	if f.kernel == nil {
+		return resize(src, dstW, dstH)
+	}
+	srcW, srcH := src.Bounds().Dx(), src.Bounds().Dy()
+	read := linearRows(src)
+
+	// horizontal pass first, it shrinks the rows the vertical pass reads
+	xw := f.weights(srcW, dstW)
+	row := make([]float32, srcW*3)
+	tmp := make([]float32, dstW*srcH*3)
+	for y := 0; y < srcH; y++ {
+		read(y, row)
+		for x, w := range xw {
+			var r, g, b float64
+			for i, v := range w.values {
+				s := (w.first + i) * 3
+				r += float64(row[s]) * v
+				g += float64(row[s+1]) * v
+				b += float64(row[s+2]) * v
+			}
+			d := (y*dstW + x) * 3
+			tmp[d], tmp[d+1], tmp[d+2] = float32(r), float32(g), float32(b)
+		}
+	}
+
+	yw := f.weights(srcH, dstH)
+	dst := newCanvas(src, dstW, dstH)
+	dstPix, dstStride, bpp := pixels(dst)
+	for y, w := range yw {
+		for x := 0; x < dstW; x++ {
+			var r, g, b float64
+			for i, v := range w.values {
+				s := ((w.first+i)*dstW + x) * 3
+				r += float64(tmp[s]) * v
+				g += float64(tmp[s+1]) * v
+				b += float64(tmp[s+2]) * v
+			}
+			d := y*dstStride + x*bpp
+			if bpp == 8 {
+				putSRGB16(dstPix[d:], r, g, b)
+				continue
+			}
+			dstPix[d] = linearToSRGB(r)
+			dstPix[d+1] = linearToSRGB(g)
+			dstPix[d+2] = linearToSRGB(b)
+			dstPix[d+3] = 255
+		}
+	}
+	return dst
+}
+
+// filterWeights are the normalized taps of one output sample, starting at
+// source sample first.
+type filterWeights struct {
+	first  int
+	values []float64
+}
+
+func (f *resampleFilter) weights(srcSize, dstSize int) []filterWeights {
+	scale := float64(srcSize) / float64(dstSize)
+	// widen the kernel when shrinking, so every source sample contributes
+	stretch := math.Max(scale, 1)
+	support := f.support * stretch
+
+	ws := make([]filterWeights, dstSize)
+	for i := range ws {
+		center := (float64(i)+0.5)*scale - 0.5
+		first := max(0, int(math.Ceil(center-support)))
+		last := min(srcSize-1, int(math.Floor(center+support)))
+
+		values := make([]float64, 0, last-first+1)
+		var sum float64
+		for j := first; j <= last; j++ {
+			v := f.kernel((float64(j) - center) / stretch)
+			values = append(values, v)
+			sum += v
+		}
+		if sum == 0 {
+			// the box kernel can miss every sample when enlarging
+			j := min(srcSize-1, max(0, int(math.Round(center))))
+			ws[i] = filterWeights{first: j, values: []float64{1}}
+			continue
+		}
+		for k := range values {
+			values[k] /= sum
+		}
+		ws[i] = filterWeights{first: first, values: values}
+	}
+	return ws
+}
+
+// linearRows returns a function filling dst with the RGB channels of row y
+// of src in linear light. YCbCr (JPEG) and RGBA sources are read directly.
+func linearRows(src image.Image) func(y int, dst []float32) {
+	bounds := src.Bounds()
+	w := bounds.Dx()
+	switch img := src.(type) {
+	case *image.YCbCr:
+		return func(y int, dst []float32) {
+			y += bounds.Min.Y
+			for x := 0; x < w; x++ {
+				yi, ci := img.YOffset(bounds.Min.X+x, y), img.COffset(bounds.Min.X+x, y)
+				r, g, b := color.YCbCrToRGB(img.Y[yi], img.Cb[ci], img.Cr[ci])
+				dst[x*3] = float32(srgbToLinear[r])
+				dst[x*3+1] = float32(srgbToLinear[g])
+				dst[x*3+2] = float32(srgbToLinear[b])
+			}
+		}
+	case *image.RGBA:
+		return func(y int, dst []float32) {
+			row := img.Pix[img.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				dst[x*3] = float32(srgbToLinear[row[x*4]])
+				dst[x*3+1] = float32(srgbToLinear[row[x*4+1]])
+				dst[x*3+2] = float32(srgbToLinear[row[x*4+2]])
+			}
+		}
+	}
+	precise := deep(src)
+	return func(y int, dst []float32) {
+		y += bounds.Min.Y
+		for x := 0; x < w; x++ {
+			r, g, b, _ := src.At(bounds.Min.X+x, y).RGBA()
+			if precise {
+				dst[x*3] = float32(linearFromSRGB(float64(r) / 257))
+				dst[x*3+1] = float32(linearFromSRGB(float64(g) / 257))
+				dst[x*3+2] = float32(linearFromSRGB(float64(b) / 257))
+			} else {
+				dst[x*3] = float32(srgbToLinear[r>>8])
+				dst[x*3+1] = float32(srgbToLinear[g>>8])
+				dst[x*3+2] = float32(srgbToLinear[b>>8])
+			}
+		}
+	}
+}
+
+// linearSteps is the resolution of the table encoding linear light to sRGB.
+const linearSteps = 4096
+
+var linearToSRGBTable = func() (t [linearSteps + 1]uint8) {
+	for i := range t {
+		t[i] = uint8(math.Round(encodeSRGB(float64(i)/linearSteps) * 255))
+	}
+	return
+}()
+
+// putSRGB16 stores linear r, g, b as an opaque 16 bit RGBA64 pixel.
+func putSRGB16(pix []byte, r, g, b float64) {
+	for c, v := range [3]float64{r, g, b} {
+		s := uint16(math.Round(encodeSRGB(math.Max(0, math.Min(1, v))) * 0xffff))
+		pix[c*2], pix[c*2+1] = byte(s>>8), byte(s)
+	}
+	pix[6], pix[7] = 0xff, 0xff
+}
+
+func encodeSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return v * 12.92
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// linearToSRGB encodes v, clamped to [0, 1]. Ringing filters overshoot.
+func linearToSRGB(v float64) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 1 {
+		return 255
+	}
+	return linearToSRGBTable[int(v*linearSteps+0.5)]
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/blecli/codec"
+	"github.com/pkg/errors"
+)
+
+const (
+	seqSize          = 8
+	sessionInfo      = "blecli session v1"
+	handshakeTimeout = 10 * time.Second
+
+	dirClientToServer byte = 0x01
+	dirServerToClient byte = 0x02
+)
+
+// parsePSK decodes a hex encoded pre-shared key. Keys shorter than 128 bits
+// are rejected.
+func parsePSK(s string) ([]byte, error) {
+	psk, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid psk")
+	}
+	if len(psk) < 16 {
+		return nil, fmt.Errorf("psk must be at least 16 bytes, got %d", len(psk))
+	}
+	return psk, nil
+}
+
+// deriveSessionKey derives the AES-256 session key from the pre-shared key
+// and both handshake nonces.
+func deriveSessionKey(psk, clientNonce, serverNonce []byte) ([]byte, error) {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+	return hkdf.Key(sha256.New, psk, salt, sessionInfo, 32)
+}
+
+// secureTransport encrypts every frame with AES-256-GCM. On the wire each
+// frame is an 8 byte big endian sequence number followed by the sealed
+// payload. The GCM nonce is the direction byte, three zero bytes and the
+// sequence number, so both sides can share one key.
+type secureTransport struct {
+	inner transport
+	aead  cipher.AEAD
+
+	mu       sync.Mutex
+	sendSeq  uint64
+	recvSeq  uint64
+	callback func(buf []byte)
+}
+
+// newSecureTransport runs the handshake over inner and returns a transport
+// that encrypts everything written to it and decrypts every notification.
+func newSecureTransport(inner transport, psk []byte) (*secureTransport, error) {
+	req := &codec.HandshakeRequest{}
+	if _, err := rand.Read(req.Nonce[:]); err != nil {
+		return nil, err
+	}
+
+	t := &secureTransport{inner: inner}
+	responses := make(chan *codec.HandshakeResponse, 1)
+	invalid := make(chan error, 1)
+	err := inner.EnableNotifications(func(buf []byte) {
+		t.mu.Lock()
+		established := t.aead != nil
+		t.mu.Unlock()
+		if established {
+			t.receive(buf)
+			return
+		}
+		resp, err := codec.DecodeResponse(codec.Handshake, buf)
+		if err != nil {
+			if len(buf) > 0 && codec.Method(buf[0]) == codec.Handshake {
+				select {
+				case invalid <- err:
+				default:
+				}
+				return
+			}
+			fmt.Printf("Ignoring notification during handshake: %q\n", buf)
+			return
+		}
+		select {
+		case responses <- resp.(*codec.HandshakeResponse):
+		default:
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	frame, err := req.Encode()
+	if err != nil {
+		return nil, err
+	}
+	err = writeWithDelay(inner, frame)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *codec.HandshakeResponse
+	select {
+	case resp = <-responses:
+	case err := <-invalid:
+		return nil, errors.Wrap(err, "handshake failed, is ble_server.py on the device up to date?")
+	case <-time.After(handshakeTimeout):
+		return nil, errors.New("handshake timed out, is the psk configured on the device?")
+	}
+
+	key, err := deriveSessionKey(psk, req.Nonce[:], resp.Nonce[:])
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	confirm := confirmTag(aead, req.Nonce[:], resp.Nonce[:])
+	if subtle.ConstantTimeCompare(confirm, resp.Confirm[:]) != 1 {
+		return nil, errors.New("handshake failed: PSK mismatch, the device has a different key")
+	}
+
+	t.mu.Lock()
+	t.aead = aead
+	t.mu.Unlock()
+	return t, nil
+}
+
+// confirmTag is the key confirmation of the handshake response: the GCM tag
+// of an empty server frame with sequence number 0, which frames never use,
+// over both nonces. Only a server holding the same session key can make it.
+func confirmTag(aead cipher.AEAD, clientNonce, serverNonce []byte) []byte {
+	nonces := append(append([]byte{}, clientNonce...), serverNonce...)
+	return aead.Seal(nil, frameNonce(dirServerToClient, 0), nil, nonces)
+}
+
+func frameNonce(dir byte, seq uint64) []byte {
+	nonce := make([]byte, 12)
+	nonce[0] = dir
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (t *secureTransport) Write(frame []byte) error {
+	t.mu.Lock()
+	t.sendSeq++
+	seq := t.sendSeq
+	t.mu.Unlock()
+
+	out := make([]byte, seqSize, seqSize+len(frame)+t.aead.Overhead())
+	binary.BigEndian.PutUint64(out, seq)
+	out = t.aead.Seal(out, frameNonce(dirClientToServer, seq), frame, nil)
+	return t.inner.Write(out)
+}
+
+func (t *secureTransport) receive(buf []byte) {
+	if len(buf) < seqSize+t.aead.Overhead() {
+		fmt.Printf("Dropping short encrypted notification (%dB): %q\n", len(buf), buf)
+		return
+	}
+	seq := binary.BigEndian.Uint64(buf)
+	plain, err := t.aead.Open(nil, frameNonce(dirServerToClient, seq), buf[seqSize:], nil)
+	if err != nil {
+		fmt.Printf("Dropping notification that failed to decrypt (%dB)\n", len(buf))
+		return
+	}
+
+	t.mu.Lock()
+	if seq <= t.recvSeq {
+		t.mu.Unlock()
+		fmt.Printf("Dropping replayed notification with sequence %d\n", seq)
+		return
+	}
+	t.recvSeq = seq
+	callback := t.callback
+	t.mu.Unlock()
+
+	if callback != nil {
+		callback(plain)
+	}
+}
+
+func (t *secureTransport) EnableNotifications(callback func(buf []byte)) error {
+	t.mu.Lock()
+	t.callback = callback
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *secureTransport) Disconnect() error {
+	return t.inner.Disconnect()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/leslie-wang/blecli/codec"
+)
+
+// secureServer plays the device side of an encrypted session, echoing every
+// frame back.
+type secureServer struct {
+	t        *testing.T
+	psk      []byte
+	reply    func(resp *codec.HandshakeResponse) []byte
+	aead     cipher.AEAD
+	sendSeq  uint64
+	callback func(buf []byte)
+}
+
+func (s *secureServer) Write(frame []byte) error {
+	if s.aead == nil {
+		req, err := codec.DecodeRequest(frame)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		clientNonce := req.(*codec.HandshakeRequest).Nonce
+		resp := &codec.HandshakeResponse{Nonce: [codec.NonceSize]byte{9, 8, 7}}
+		key, err := deriveSessionKey(s.psk, clientNonce[:], resp.Nonce[:])
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		s.aead, _ = cipher.NewGCM(block)
+		copy(resp.Confirm[:], confirmTag(s.aead, clientNonce[:], resp.Nonce[:]))
+		s.callback(s.reply(resp))
+		return nil
+	}
+
+	seq := binary.BigEndian.Uint64(frame)
+	plain, err := s.aead.Open(nil, frameNonce(dirClientToServer, seq), frame[seqSize:], nil)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.sendSeq++
+	out := binary.BigEndian.AppendUint64(nil, s.sendSeq)
+	s.callback(s.aead.Seal(out, frameNonce(dirServerToClient, s.sendSeq), plain, nil))
+	return nil
+}
+
+func (s *secureServer) EnableNotifications(callback func(buf []byte)) error {
+	s.callback = callback
+	return nil
+}
+
+func (s *secureServer) Disconnect() error { return nil }
+
+func encodeResponse(resp *codec.HandshakeResponse) []byte {
+	frame, _ := resp.Encode()
+	return frame
+}
+
+func TestSecureTransport(t *testing.T) {
+	oldWriteDelay := writeDelay
+	t.Cleanup(func() { writeDelay = oldWriteDelay })
+	writeDelay = 0
+
+	psk := bytes.Repeat([]byte{0x42}, 32)
+	server := &secureServer{t: t, psk: psk, reply: encodeResponse}
+	st, err := newSecureTransport(server, psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echoed [][]byte
+	st.EnableNotifications(func(buf []byte) { echoed = append(echoed, buf) })
+	for _, frame := range []string{"\x00ping!", "\x03"} {
+		if err := st.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(echoed) != 2 || string(echoed[0]) != "\x00ping!" || string(echoed[1]) != "\x03" {
+		t.Errorf("echoed %q", echoed)
+	}
+}
+
+func TestSecureTransportHandshakeErrors(t *testing.T) {
+	oldWriteDelay := writeDelay
+	t.Cleanup(func() { writeDelay = oldWriteDelay })
+	writeDelay = 0
+
+	psk := bytes.Repeat([]byte{0x42}, 32)
+	for _, tc := range []struct {
+		name      string
+		serverPSK []byte
+		reply     func(resp *codec.HandshakeResponse) []byte
+		want      string
+	}{
+		{"other key", bytes.Repeat([]byte{0x24}, 32), encodeResponse, "PSK mismatch"},
+		{"forged confirmation", psk, func(resp *codec.HandshakeResponse) []byte {
+			resp.Confirm[0] ^= 1
+			return encodeResponse(resp)
+		}, "PSK mismatch"},
+		{"no confirmation", psk, func(resp *codec.HandshakeResponse) []byte {
+			return encodeResponse(resp)[:1+codec.NonceSize]
+		}, "up to date"},
+	} {
+		server := &secureServer{t: t, psk: tc.serverPSK, reply: tc.reply}
+		if _, err := newSecureTransport(server, psk); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want %s", tc.name, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/image/tiff"
+)
+
+// frameSelection picks frames of an animation or pages of a multi-page
+// image, numbered from 1.
+type frameSelection struct {
+	// ranges are inclusive, a last of 0 runs to the final frame
+	ranges [][2]int
+	// step keeps every step-th selected frame
+	step int
+}
+
+// parseFrames parses "all" or a comma separated list of frames and ranges
+// such as "1-10,15,20-".
+func parseFrames(spec string, step int) (*frameSelection, error) {
+	if step < 1 {
+		return nil, fmt.Errorf("frame step %d is not positive", step)
+	}
+	sel := &frameSelection{step: step}
+	if spec == "all" {
+		sel.ranges = [][2]int{{1, 0}}
+		return sel, nil
+	}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		first, last, isRange := strings.Cut(part, "-")
+		a, err := strconv.Atoi(first)
+		if err != nil || a < 1 {
+			return nil, fmt.Errorf("frames %q is not all or a list of frames and ranges like 1-10,15,20-", spec)
+		}
+		b := a
+		if isRange {
+			b = 0
+			if last != "" {
+				b, err = strconv.Atoi(last)
+				if err != nil || b < a {
+					return nil, fmt.Errorf("frames %q has a bad range %q", spec, part)
+				}
+			}
+		}
+		sel.ranges = append(sel.ranges, [2]int{a, b})
+	}
+	return sel, nil
+}
+
+// pick returns the 0 based indices of the selected frames out of count, in
+// order.
+func (sel *frameSelection) pick(count int) []int {
+	var picked []int
+	n := 0
+	for i := 0; i < count; i++ {
+		selected := false
+		for _, r := range sel.ranges {
+			if i+1 >= r[0] && (r[1] == 0 || i+1 <= r[1]) {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			continue
+		}
+		if n%sel.step == 0 {
+			picked = append(picked, i)
+		}
+		n++
+	}
+	return picked
+}
+
+// frameFunc receives a frame and its 0 based position in the input. The
+// image is only valid during the call.
+type frameFunc func(index int, img image.Image) error
+
+// frameSequence is the frames of an input, decoded on demand so that only
+// one is held at a time.
+type frameSequence struct {
+	count int
+	// decode hands the frames at indices, which are in order, to fn
+	decode func(indices []int, fn frameFunc) error
+}
+
+// readFrames reads a GIF animation or a multi-page TIFF for decoding frame
+// by frame. Other formats have the single frame first.
+func readFrames(r io.Reader, format string, first image.Image) (*frameSequence, error) {
+	switch format {
+	case "gif":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		head, frames, err := scanGIF(data)
+		if err != nil {
+			return nil, err
+		}
+		return &frameSequence{len(frames), func(indices []int, fn frameFunc) error {
+			return gifFrames(data, head, frames, indices, fn)
+		}}, nil
+
+	case "tiff":
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		pages, err := tiffPages(data)
+		if err != nil {
+			return nil, err
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if data[0] == 'M' {
+			order = binary.BigEndian
+		}
+		return &frameSequence{len(pages), func(indices []int, fn frameFunc) error {
+			for _, i := range indices {
+				page := &tiffPage{data: data}
+				copy(page.header[:], data[:4])
+				order.PutUint32(page.header[4:], pages[i])
+				img, err := tiff.Decode(io.NewSectionReader(page, 0, int64(len(data))))
+				if err != nil {
+					return errors.Wrapf(err, "read page %d", i+1)
+				}
+				if err = fn(i, img); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}, nil
+	}
+
+	return &frameSequence{1, func(indices []int, fn frameFunc) error {
+		for _, i := range indices {
+			if err := fn(i, first); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}, nil
+}
+
+// gifFrame is where a frame of a GIF file starts, with the extensions
+// before its image, and how it is disposed of.
+type gifFrame struct {
+	offset   int
+	disposal byte
+}
+
+// scanGIF walks the blocks of a GIF file without decoding any image. It
+// returns the length of the header, logical screen descriptor and global
+// color table, and the frames.
+func scanGIF(data []byte) (int, []gifFrame, error) {
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return 0, nil, errors.New("not a GIF file")
+	}
+	head := 13
+	if data[10]&0x80 != 0 {
+		head += 3 << (data[10]&7 + 1)
+	}
+
+	var frames []gifFrame
+	next := gifFrame{offset: head}
+	for p := head; ; {
+		if p >= len(data) {
+			return 0, nil, errors.New("GIF truncated")
+		}
+		var err error
+		switch data[p] {
+		case 0x21:
+			// graphic control extension: label, size, packed fields
+			if p+3 < len(data) && data[p+1] == 0xF9 {
+				next.disposal = data[p+3] >> 2 & 7
+			}
+			p, err = skipGIFBlocks(data, p+2)
+		case 0x2C:
+			if p+10 > len(data) {
+				return 0, nil, errors.New("GIF image descriptor truncated")
+			}
+			flags := data[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (flags&7 + 1)
+			}
+			// past the LZW minimum code size
+			p, err = skipGIFBlocks(data, p+1)
+			frames = append(frames, next)
+			next = gifFrame{offset: p}
+		case 0x3B:
+			return head, frames, nil
+		default:
+			return 0, nil, errors.Errorf("bad GIF block %#x", data[p])
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// skipGIFBlocks returns the offset after the data sub-blocks at p.
+func skipGIFBlocks(data []byte, p int) (int, error) {
+	for {
+		if p >= len(data) {
+			return 0, errors.New("GIF truncated")
+		}
+		n := int(data[p])
+		p += 1 + n
+		if n == 0 {
+			return p, nil
+		}
+	}
+}
+
+// gifFrames renders the frames at indices as they are shown: each frame is
+// drawn over what the disposal of the previous one left on the canvas. The
+// frames are decoded one at a time, by handing gif.Decode, which stops after
+// the first image, the header followed by the frame.
+func gifFrames(data []byte, head int, frames []gifFrame, indices []int, fn frameFunc) error {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+
+	for i, f := range frames {
+		if len(indices) == 0 {
+			break
+		}
+		frame, err := gif.Decode(io.MultiReader(bytes.NewReader(data[:head]), bytes.NewReader(data[f.offset:])))
+		if err != nil {
+			return errors.Wrapf(err, "read frame %d", i+1)
+		}
+		var previous *image.RGBA
+		if f.disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if indices[0] == i {
+			if err = fn(i, canvas); err != nil {
+				return err
+			}
+			indices = indices[1:]
+		}
+
+		switch f.disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return nil
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(img.Rect)
+	copy(c.Pix, img.Pix)
+	return c
+}
+
+// tiffPages returns the offsets of the IFDs of the full resolution pages of
+// a TIFF file, skipping reduced resolution copies such as thumbnails.
+func tiffPages(data []byte) ([]uint32, error) {
+	if len(data) < 8 {
+		return nil, errors.New("TIFF header truncated")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("bad TIFF byte order")
+	}
+
+	const tagNewSubfileType = 254
+	var pages []uint32
+	seen := map[uint32]bool{}
+	for offset := order.Uint32(data[4:]); offset != 0; {
+		if seen[offset] {
+			return nil, errors.New("TIFF IFD chain loops")
+		}
+		seen[offset] = true
+
+		reduced := false
+		err := readIFD(data, order, offset, func(tag, typ uint16, count uint32, value []byte) {
+			if tag == tagNewSubfileType && typ == 4 {
+				reduced = order.Uint32(value)&1 != 0
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !reduced {
+			pages = append(pages, offset)
+		}
+
+		next := uint64(offset) + 2 + 12*uint64(order.Uint16(data[offset:]))
+		if next+4 > uint64(len(data)) {
+			return nil, errors.New("TIFF IFD truncated")
+		}
+		offset = order.Uint32(data[next:])
+	}
+	return pages, nil
+}
+
+// tiffPage reads a TIFF file as if its first IFD were the one in header,
+// which makes the tiff package decode that page.
+type tiffPage struct {
+	data   []byte
+	header [8]byte
+}
+
+func (p *tiffPage) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(p.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, p.data[off:])
+	for i := off; i < int64(len(p.header)) && i < off+int64(n); i++ {
+		b[i-off] = p.header[i]
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// convertSequence converts the frames at indices of seq into numbered .bmp
+// and .epa files after outputBase as they are decoded, lists the .epa files
+// in play order in a playlist and reports them on w. It returns the panel
+// data of the first frame.
+func (conv *conversion) convertSequence(seq *frameSequence, indices []int, outputBase string, w io.Writer) ([]byte, error) {
+	digits := max(3, len(strconv.Itoa(seq.count)))
+
+	var playlist strings.Builder
+	var firstData []byte
+	err := seq.decode(indices, func(index int, img image.Image) error {
+		result, epaperResult, err := conv.convert(img)
+		if err != nil {
+			return errors.Wrapf(err, "frame %d", index+1)
+		}
+		if firstData == nil {
+			firstData = epaperResult
+		}
+
+		base := fmt.Sprintf("%s.%0*d", outputBase, digits, index+1)
+		outputFilename, epaperFilename := base+".bmp", base+".epa"
+		if err = writeOutputs(outputFilename, epaperFilename, result, epaperResult); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Dithering complete. Output saved to %s and %s\n",
+			outputFilename, epaperFilename)
+		fmt.Fprintln(&playlist, filepath.Base(epaperFilename))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	playlistFilename := outputBase + ".playlist"
+	if err := os.WriteFile(playlistFilename, []byte(playlist.String()), 0644); err != nil {
+		return nil, err
+	}
+	fmt.Fprintln(w, "Playlist saved to", playlistFilename)
+	return firstData, nil
+}
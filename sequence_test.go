@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"reflect"
+	"testing"
+)
+
+func TestParseFrames(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		step  int
+		count int
+		want  []int
+	}{
+		{"all", 1, 4, []int{0, 1, 2, 3}},
+		{"all", 2, 5, []int{0, 2, 4}},
+		{"3", 1, 5, []int{2}},
+		{"1-3,5", 1, 6, []int{0, 1, 2, 4}},
+		{" 1 , 3 ", 1, 4, []int{0, 2}},
+		{"2-", 1, 4, []int{1, 2, 3}},
+		{"1-3,2-4", 1, 6, []int{0, 1, 2, 3}},
+		{"1-3,5-6", 2, 8, []int{0, 2, 5}},
+		{"1-10", 1, 3, []int{0, 1, 2}},
+		{"7", 1, 3, nil},
+		{"all", 1, 0, nil},
+	} {
+		sel, err := parseFrames(tc.spec, tc.step)
+		if err != nil {
+			t.Errorf("%q step %d: %v", tc.spec, tc.step, err)
+			continue
+		}
+		if got := sel.pick(tc.count); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q step %d of %d: picked %v, want %v", tc.spec, tc.step, tc.count, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		spec string
+		step int
+	}{
+		{"", 1},
+		{"0", 1},
+		{"-3", 1},
+		{"a", 1},
+		{"1,,2", 1},
+		{"3-2", 1},
+		{"1-x", 1},
+		{"1-2-3", 1},
+		{"all", 0},
+		{"all", -1},
+	} {
+		if sel, err := parseFrames(tc.spec, tc.step); err == nil {
+			t.Errorf("%q step %d: parsed %+v, want an error", tc.spec, tc.step, sel)
+		}
+	}
+}
+
+var (
+	red         = color.RGBA{0xff, 0, 0, 0xff}
+	green       = color.RGBA{0, 0xff, 0, 0xff}
+	blue        = color.RGBA{0, 0, 0xff, 0xff}
+	white       = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	transparent = color.RGBA{}
+)
+
+// disposalGIF is a 4x2 animation using every disposal method:
+//
+//	0: all red, kept
+//	1: green top left 2x1, cleared to the background afterwards
+//	2: blue top right 2x1, undone afterwards
+//	3: bottom middle 2x1 of a transparent and a white pixel, kept
+func disposalGIF(t testing.TB) []byte {
+	pal := color.Palette{red, green, blue, white, color.Transparent}
+	frame := func(r image.Rectangle, indices ...uint8) *image.Paletted {
+		m := image.NewPaletted(r, pal)
+		copy(m.Pix, indices)
+		return m
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 2), 0, 0, 0, 0, 0, 0, 0, 0),
+			frame(image.Rect(0, 0, 2, 1), 1, 1),
+			frame(image.Rect(2, 0, 4, 1), 2, 2),
+			frame(image.Rect(1, 1, 3, 2), 4, 3),
+		},
+		Delay:    []int{10, 10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious, gif.DisposalNone},
+		Config:   image.Config{Width: 4, Height: 2},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func colorRows(img image.Image) [][]color.RGBA {
+	bounds := img.Bounds()
+	var rows [][]color.RGBA
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		var row []color.RGBA
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			row = append(row, color.RGBAModel.Convert(img.At(x, y)).(color.RGBA))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// decodedFrames collects copies of the frames seq hands out at indices.
+func decodedFrames(t *testing.T, seq *frameSequence, indices []int) map[int][][]color.RGBA {
+	t.Helper()
+	frames := map[int][][]color.RGBA{}
+	err := seq.decode(indices, func(index int, img image.Image) error {
+		frames[index] = colorRows(img)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames
+}
+
+func TestGIFFrames(t *testing.T) {
+	shown := map[int][][]color.RGBA{
+		0: {{red, red, red, red}, {red, red, red, red}},
+		1: {{green, green, red, red}, {red, red, red, red}},
+		2: {{transparent, transparent, blue, blue}, {red, red, red, red}},
+		3: {{transparent, transparent, red, red}, {red, red, white, red}},
+	}
+
+	data := disposalGIF(t)
+	seq, err := readFrames(bytes.NewReader(data), "gif", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq.count != 4 {
+		t.Fatalf("%d frames, want 4", seq.count)
+	}
+	for _, indices := range [][]int{{0, 1, 2, 3}, {3}, {1, 3}} {
+		got := decodedFrames(t, seq, indices)
+		if len(got) != len(indices) {
+			t.Errorf("%v: got frames %v", indices, got)
+		}
+		for _, i := range indices {
+			if !reflect.DeepEqual(got[i], shown[i]) {
+				t.Errorf("%v: frame %d is %v, want %v", indices, i, got[i], shown[i])
+			}
+		}
+	}
+}
+
+func TestScanGIFErrors(t *testing.T) {
+	data := disposalGIF(t)
+	head, frames, err := scanGIF(data)
+	if err != nil || len(frames) != 4 || head < 13 {
+		t.Fatalf("scanned %d, %v, %v", head, frames, err)
+	}
+	badBlock := append([]byte(nil), data...)
+	badBlock[frames[1].offset] = 0x99
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a GIF", append([]byte("PNG89a"), data[6:]...)},
+		{"header only", data[:head]},
+		{"no trailer", data[:len(data)-1]},
+		{"truncated image", data[:frames[2].offset-3]},
+		{"bad block", badBlock},
+	} {
+		if _, frames, err := scanGIF(tc.data); err == nil {
+			t.Errorf("%s: scanned %v, want an error", tc.name, frames)
+		}
+	}
+}
+
+// tiffTestPage is a page of a test TIFF, a w x h gray image of one value.
+type tiffTestPage struct {
+	w, h    int
+	gray    uint8
+	reduced bool
+}
+
+// buildTIFF writes uncompressed 8 bit gray pages, each IFD followed by its
+// strip.
+func buildTIFF(pages []tiffTestPage) []byte {
+	order := binary.LittleEndian
+	data := []byte("II*\x00\x08\x00\x00\x00")
+	for i, p := range pages {
+		var subfile uint32
+		if p.reduced {
+			subfile = 1
+		}
+		entries := []exifEntry{
+			{254, 4, 1, subfile},
+			{256, 3, 1, uint32(p.w)},
+			{257, 3, 1, uint32(p.h)},
+			{258, 3, 1, 8},
+			{259, 3, 1, 1},
+			{262, 3, 1, 1},
+			{273, 4, 1, 0},
+			{278, 3, 1, uint32(p.h)},
+			{279, 4, 1, uint32(p.w * p.h)},
+		}
+		ifdSize := 2 + 12*len(entries) + 4
+		entries[6].value = uint32(len(data) + ifdSize)
+		ifd := buildIFD(order, entries)
+		if i < len(pages)-1 {
+			next := len(data) + ifdSize + p.w*p.h
+			order.PutUint32(ifd[ifdSize-4:], uint32(next))
+		}
+		data = append(data, ifd...)
+		data = append(data, bytes.Repeat([]byte{p.gray}, p.w*p.h)...)
+	}
+	return data
+}
+
+func TestTIFFPages(t *testing.T) {
+	data := buildTIFF([]tiffTestPage{
+		{4, 3, 10, false},
+		{2, 1, 99, true},
+		{4, 3, 20, false},
+		{5, 2, 30, false},
+	})
+	seq, err := readFrames(bytes.NewReader(data), "tiff", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the thumbnail is not a page
+	if seq.count != 3 {
+		t.Fatalf("%d pages, want 3", seq.count)
+	}
+	err = seq.decode([]int{0, 2}, func(index int, img image.Image) error {
+		want := map[int]struct {
+			w, h int
+			gray uint8
+		}{0: {4, 3, 10}, 2: {5, 2, 30}}[index]
+		if img.Bounds().Dx() != want.w || img.Bounds().Dy() != want.h {
+			t.Errorf("page %d is %v, want %dx%d", index+1, img.Bounds(), want.w, want.h)
+		}
+		if g := color.GrayModel.Convert(img.At(1, 1)).(color.Gray).Y; g != want.gray {
+			t.Errorf("page %d has gray %d, want %d", index+1, g, want.gray)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTIFFPagesErrors(t *testing.T) {
+	loop := buildTIFF([]tiffTestPage{{2, 2, 1, false}})
+	// point the only IFD back at itself
+	binary.LittleEndian.PutUint32(loop[8+2+9*12:], 8)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad byte order", append([]byte("XX"), loop[2:]...)},
+		{"IFD past the end", []byte("II*\x00\xff\x00\x00\x00")},
+		{"truncated IFD", loop[:20]},
+		{"loop", loop},
+	} {
+		if pages, err := tiffPages(tc.data); err == nil {
+			t.Errorf("%s: got pages %v, want an error", tc.name, pages)
+		}
+	}
+}
+
+func TestSingleFrame(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	seq, err := readFrames(nil, "png", img)
+	if err != nil || seq.count != 1 {
+		t.Fatalf("%+v, %v", seq, err)
+	}
+	n := 0
+	seq.decode([]int{0}, func(index int, got image.Image) error {
+		if index != 0 || got != img {
+			t.Errorf("frame %d is %p, want %p", index, got, img)
+		}
+		n++
+		return nil
+	})
+	if n != 1 {
+		t.Errorf("%d frames", n)
+	}
+}
+
+func FuzzScanGIF(f *testing.F) {
+	f.Add(disposalGIF(f))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		head, frames, err := scanGIF(data)
+		if err != nil {
+			return
+		}
+		prev := head
+		for _, frame := range frames {
+			if frame.offset < prev || frame.offset >= len(data) {
+				t.Fatalf("frame at %d after %d of %d bytes", frame.offset, prev, len(data))
+			}
+			prev = frame.offset
+		}
+		// decoding may fail, but not panic; small screens keep it quick
+		config, err := gif.DecodeConfig(bytes.NewReader(data))
+		if err != nil || config.Width*config.Height > 1<<16 {
+			return
+		}
+		indices := make([]int, len(frames))
+		for i := range indices {
+			indices[i] = i
+		}
+		gifFrames(data, head, frames, indices, func(int, image.Image) error { return nil })
+	})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/leslie-wang/blecli/codec"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	traceWrite  = "write"
+	traceNotify = "notify"
+
+	kindRequest      = "request"
+	kindContinuation = "continuation"
+	kindResponse     = "response"
+)
+
+// traceRecord is one line of a trace file.
+type traceRecord struct {
+	Time   time.Time `json:"time"`
+	Dir    string    `json:"dir"`
+	Kind   string    `json:"kind"`
+	Method string    `json:"method"`
+	Len    int       `json:"len"`
+	Hex    string    `json:"hex"`
+}
+
+func (r *traceRecord) payload() ([]byte, error) {
+	return hex.DecodeString(r.Hex)
+}
+
+// frameDecoder tells requests, upload continuation writes and responses
+// apart. Continuations carry no method byte, so it has to follow the upload
+// size announced in the request, whose header may itself span several writes.
+type frameDecoder struct {
+	method          codec.Method
+	uploadHeader    []byte
+	uploadRemaining int
+}
+
+func (d *frameDecoder) decode(dir string, frame []byte) (kind string, m codec.Method) {
+	if dir == traceNotify {
+		return kindResponse, d.method
+	}
+	if d.uploadHeader != nil {
+		d.startUpload(append(d.uploadHeader, frame...))
+		return kindContinuation, codec.Upload
+	}
+	if d.uploadRemaining > 0 {
+		d.uploadRemaining -= len(frame)
+		return kindContinuation, codec.Upload
+	}
+	if len(frame) == 0 {
+		return kindRequest, d.method
+	}
+
+	d.method = codec.Method(frame[0])
+	if d.method == codec.Upload {
+		d.startUpload(append([]byte(nil), frame...))
+	}
+	return kindRequest, d.method
+}
+
+// startUpload follows an upload request once its header is complete.
+func (d *frameDecoder) startUpload(frame []byte) {
+	if len(frame) < 1+codec.FileHeaderSize {
+		d.uploadHeader = frame
+		return
+	}
+	d.uploadHeader = nil
+	if req, err := codec.DecodeRequest(frame); err == nil {
+		d.uploadRemaining = req.(*codec.UploadRequest).Remaining()
+	}
+}
+
+// traceTransport records every frame written to and notified by inner.
+type traceTransport struct {
+	inner transport
+
+	mu      sync.Mutex
+	f       *os.File
+	enc     *json.Encoder
+	decoder frameDecoder
+}
+
+func newTraceTransport(inner transport, filename string) (*traceTransport, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &traceTransport{
+		inner: inner,
+		f:     f,
+		enc:   json.NewEncoder(f),
+	}, nil
+}
+
+func (t *traceTransport) record(dir string, frame []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kind, m := t.decoder.decode(dir, frame)
+	err := t.enc.Encode(traceRecord{
+		Time:   time.Now(),
+		Dir:    dir,
+		Kind:   kind,
+		Method: m.String(),
+		Len:    len(frame),
+		Hex:    hex.EncodeToString(frame),
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: write trace:", err)
+	}
+}
+
+func (t *traceTransport) Write(frame []byte) error {
+	t.record(traceWrite, frame)
+	return t.inner.Write(frame)
+}
+
+func (t *traceTransport) EnableNotifications(callback func(buf []byte)) error {
+	return t.inner.EnableNotifications(func(buf []byte) {
+		t.record(traceNotify, buf)
+		if callback != nil {
+			callback(buf)
+		}
+	})
+}
+
+func (t *traceTransport) Disconnect() error {
+	err := t.inner.Disconnect()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readTrace(filename string) ([]traceRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []traceRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r traceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", filename, line)
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// describeFrame decodes the fields of a request or response into one line.
+func describeFrame(kind string, m codec.Method, frame []byte) string {
+	var (
+		msg codec.Message
+		err error
+	)
+	switch {
+	case kind == kindContinuation:
+		return fmt.Sprintf("%d content bytes", len(frame))
+	case kind == kindRequest && m == codec.Upload && len(frame) < 1+codec.FileHeaderSize:
+		return fmt.Sprintf("%d of %d header bytes", len(frame)-1, codec.FileHeaderSize)
+	case kind == kindResponse:
+		msg, err = codec.DecodeResponse(m, frame)
+	default:
+		msg, err = codec.DecodeRequest(frame)
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if s, ok := msg.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return ""
+}
+
+func hexPreview(frame []byte, full bool) string {
+	const limit = 32
+	if full || len(frame) <= limit {
+		return hex.EncodeToString(frame)
+	}
+	return hex.EncodeToString(frame[:limit]) + "..."
+}
+
+func runTraceShow(c *cli.Context) error {
+	if len(c.Args()) != 1 {
+		return errors.New("Usage: trace show trace.jsonl")
+	}
+
+	records, err := readTrace(c.Args()[0])
+	if err != nil {
+		return err
+	}
+
+	var decoder frameDecoder
+	for i, r := range records {
+		frame, err := r.payload()
+		if err != nil {
+			return errors.Wrapf(err, "record %d", i+1)
+		}
+		kind, m := decoder.decode(r.Dir, frame)
+
+		arrow := "->"
+		if r.Dir == traceNotify {
+			arrow = "<-"
+		}
+		var offset time.Duration
+		if i > 0 {
+			offset = r.Time.Sub(records[0].Time)
+		}
+		fmt.Printf("%s +%9.3fs %s %-9s %-12s %5dB %s\n", r.Time.Format("15:04:05.000"),
+			offset.Seconds(), arrow, m, kind, len(frame), describeFrame(kind, m, frame))
+		fmt.Printf("%36s%s\n", "", hexPreview(frame, c.Bool("full")))
+	}
+	return nil
+}
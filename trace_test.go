@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/leslie-wang/blecli/codec"
+)
+
+func TestFrameDecoder(t *testing.T) {
+	for _, name := range []string{"testdata/upload.jsonl", "testdata/upload-mtu23.jsonl", "testdata/list.jsonl"} {
+		records, err := readTrace(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d frameDecoder
+		for i, r := range records {
+			frame, err := r.payload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			kind, m := d.decode(r.Dir, frame)
+			if kind != r.Kind || m.String() != r.Method {
+				t.Errorf("%s record %d: decoded %s %s, want %s %s", name, i+1, kind, m, r.Kind, r.Method)
+			}
+		}
+	}
+}
+
+func TestFrameDecoderSplitHeader(t *testing.T) {
+	frame, err := (&codec.UploadRequest{Size: 3, Content: []byte("abc")}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header split three ways, then one request after the upload
+	var d frameDecoder
+	for i, tc := range []struct {
+		frame []byte
+		kind  string
+	}{
+		{frame[:5], kindRequest},
+		{frame[5:15], kindContinuation},
+		{frame[15:22], kindContinuation},
+		{frame[22:], kindContinuation},
+		{[]byte{byte(codec.List)}, kindRequest},
+	} {
+		if kind, _ := d.decode(traceWrite, tc.frame); kind != tc.kind {
+			t.Errorf("write %d: %s, want %s", i+1, kind, tc.kind)
+		}
+	}
+	if got := describeFrame(kindRequest, codec.Upload, frame[:5]); got != "4 of 20 header bytes" {
+		t.Errorf("described a partial header as %q", got)
+	}
+}
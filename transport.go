@@ -0,0 +1,33 @@
+package main
+
+import (
+	"tinygo.org/x/bluetooth"
+)
+
+// transport carries protocol frames between the client and the peripheral.
+// Every Write is sent as one frame, and every notification is handed to the
+// callback as one frame.
+type transport interface {
+	Write(frame []byte) error
+	EnableNotifications(callback func(buf []byte)) error
+	Disconnect() error
+}
+
+type bleTransport struct {
+	device     bluetooth.Device
+	writeChar  bluetooth.DeviceCharacteristic
+	notifyChar bluetooth.DeviceCharacteristic
+}
+
+func (t *bleTransport) Write(frame []byte) error {
+	_, err := t.writeChar.WriteWithoutResponse(frame)
+	return err
+}
+
+func (t *bleTransport) EnableNotifications(callback func(buf []byte)) error {
+	return t.notifyChar.EnableNotifications(callback)
+}
+
+func (t *bleTransport) Disconnect() error {
+	return t.device.Disconnect()
+}